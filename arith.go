@@ -0,0 +1,176 @@
+package stackvm
+
+import (
+	"fmt"
+	"math"
+)
+
+// IntegerMode is the behavior of integer arithmetic when a result overflows.
+type IntegerMode uint8
+
+const (
+	// IntegerWrap makes overflowing results wrap around, as in two's complement. This is
+	// the default mode.
+	IntegerWrap IntegerMode = iota
+
+	// IntegerTrap makes overflowing results fail with ErrArithmetic.
+	IntegerTrap
+
+	// IntegerSaturate makes overflowing results clamp to the closest representable value.
+	IntegerSaturate
+)
+
+var integerModeNames = map[IntegerMode]string{
+	IntegerWrap:     "wrap",
+	IntegerTrap:     "trap",
+	IntegerSaturate: "saturate",
+}
+
+func (m IntegerMode) String() string {
+	return integerModeNames[m]
+}
+
+// FloatPolicy is the behavior of float arithmetic when a result is NaN or infinite.
+type FloatPolicy uint8
+
+const (
+	// FloatIEEE keeps NaN and infinite results, as defined by IEEE 754. This is the
+	// default policy.
+	FloatIEEE FloatPolicy = iota
+
+	// FloatTrap makes NaN and infinite results fail with ErrArithmetic.
+	FloatTrap
+)
+
+var floatPolicyNames = map[FloatPolicy]string{
+	FloatIEEE: "ieee",
+	FloatTrap: "trap",
+}
+
+func (p FloatPolicy) String() string {
+	return floatPolicyNames[p]
+}
+
+// intResult narrows the exact result of an integer operation according to the given mode.
+func intResult(r int64, mode IntegerMode) (int32, error) {
+	if r >= math.MinInt32 && r <= math.MaxInt32 {
+		return int32(r), nil
+	}
+	switch mode {
+	case IntegerTrap:
+		return 0, fmt.Errorf("%w: integer overflow", ErrArithmetic)
+	case IntegerSaturate:
+		if r < 0 {
+			return math.MinInt32, nil
+		}
+		return math.MaxInt32, nil
+	default:
+		return int32(r), nil
+	}
+}
+
+// checkFloat checks the result of a float operation according to the given policy.
+func checkFloat(r float64, policy FloatPolicy) error {
+	if policy == FloatTrap {
+		if math.IsNaN(r) {
+			return fmt.Errorf("%w: float result is NaN", ErrArithmetic)
+		} else if math.IsInf(r, 0) {
+			return fmt.Errorf("%w: float result is infinite", ErrArithmetic)
+		}
+	}
+	return nil
+}
+
+// pushInt pushes the exact result of an integer operation, narrowed according to the
+// integer mode of the virtual machine.
+func (vm *VirtualMachine) pushInt(r int64) error {
+	return vm.pushIntMode(r, vm.intMode)
+}
+
+// pushIntMode pushes the exact result of an integer operation, narrowed according to the
+// given mode.
+func (vm *VirtualMachine) pushIntMode(r int64, mode IntegerMode) error {
+	v, err := intResult(r, mode)
+	if err != nil {
+		return err
+	}
+	return vm.stack.push(NewInt(v))
+}
+
+// pushFloat pushes the result of a float operation, checked according to the float
+// policy of the virtual machine.
+func (vm *VirtualMachine) pushFloat(r float32) error {
+	if err := checkFloat(float64(r), vm.floatPolicy); err != nil {
+		return err
+	}
+	return vm.stack.push(NewFloat(r))
+}
+
+// pushFloat64 pushes the result of a 64-bit float operation, checked according to the
+// float policy of the virtual machine.
+func (vm *VirtualMachine) pushFloat64(r float64) error {
+	if err := checkFloat(r, vm.floatPolicy); err != nil {
+		return err
+	}
+	return vm.stack.push(NewFloat64(r))
+}
+
+// pushInt64 pushes the wrapped result of a 64-bit integer operation. If it overflowed,
+// it is handled according to the integer mode of the virtual machine, saturating to the
+// sign of the exact result given by positive.
+func (vm *VirtualMachine) pushInt64(r int64, overflow, positive bool) error {
+	if overflow {
+		switch vm.intMode {
+		case IntegerTrap:
+			return fmt.Errorf("%w: integer overflow", ErrArithmetic)
+		case IntegerSaturate:
+			r = math.MinInt64
+			if positive {
+				r = math.MaxInt64
+			}
+		}
+	}
+	return vm.stack.push(NewInt64(r))
+}
+
+// add64 adds two 64-bit integers, returning the wrapped result, whether it overflowed and
+// whether the exact result is positive.
+func add64(a, b int64) (int64, bool, bool) {
+	r := a + b
+	return r, (a >= 0) == (b >= 0) && (r >= 0) != (a >= 0), a >= 0
+}
+
+// sub64 subtracts two 64-bit integers, like add64.
+func sub64(a, b int64) (int64, bool, bool) {
+	r := a - b
+	return r, (a >= 0) != (b >= 0) && (r >= 0) != (a >= 0), a >= 0
+}
+
+// mul64 multiplies two 64-bit integers, like add64.
+func mul64(a, b int64) (int64, bool, bool) {
+	r := a * b
+	overflow := a != 0 && (r/a != b || (a == -1 && b == math.MinInt64))
+	return r, overflow, (a < 0) == (b < 0)
+}
+
+// divide pushes the quotient or the remainder of two integers.
+func (vm *VirtualMachine) divide(a, b int32, mod bool) error {
+	if b == 0 {
+		return fmt.Errorf("%w: integer division by zero", ErrArithmetic)
+	}
+	if mod {
+		return vm.pushInt(int64(a) % int64(b))
+	}
+	return vm.pushInt(int64(a) / int64(b))
+}
+
+// divide64 pushes the quotient or the remainder of two 64-bit integers.
+func (vm *VirtualMachine) divide64(a, b int64, mod bool) error {
+	if b == 0 {
+		return fmt.Errorf("%w: integer division by zero", ErrArithmetic)
+	}
+	if mod {
+		return vm.pushInt64(a%b, false, false)
+	}
+	return vm.pushInt64(a/b, a == math.MinInt64 && b == -1, true)
+}
@@ -0,0 +1,580 @@
+package stackvm
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// AssemblyError is returned when an assembly source cannot be assembled. It locates the
+// cause of the failure in the source.
+type AssemblyError struct {
+	Line   int
+	Column int
+	Err    error
+}
+
+func (e *AssemblyError) Error() string {
+	return fmt.Sprintf("%d:%d: %v", e.Line, e.Column, e.Err)
+}
+
+// Unwrap returns the cause of the failure, which wraps ErrInvalidProgram unless the
+// assembler failed for an unexpected reason.
+func (e *AssemblyError) Unwrap() error {
+	return e.Err
+}
+
+// Assemble assembles a program written in the stackvm assembly language and returns the
+// prototype of its entry function.
+//
+// The source is line oriented, and comments run from ';' to the end of the line. Functions
+// are enclosed by a ".func name nargs" directive and an ".end" directive. Inside a function,
+// "name:" marks a label and any other line is an instruction: a mnemonic named after its
+// encoder function (PUSHI, ADDI, BR...) followed by its comma-separated operands. Jump
+// instructions take a label, PUSHK takes a literal constant (an integer, a float, a 64-bit
+// integer or float suffixed by L or D, true, false, none, a quoted string or a function
+// name), CLOSURE takes a function name, and GETGLOBAL and SETGLOBAL take a quoted string.
+// Any of them can also take '#' followed by the index of a constant already in the pool.
+// The ".variadic" directive makes a function accept extra arguments, the ".locals n" and
+// ".results n" directives declare the number of locals and results of a function, the
+// ".paramtypes" and ".resulttypes" directives declare the types of its arguments and
+// results (int, float, int64, float64, bool, string, function, hostfunction, error,
+// coroutine or none), the ".upval local n" and ".upval upval n" directives declare its
+// upvalues, the ".handler start end target" directive registers an exception handler
+// between labels, the ".const" directive appends a constant to the pool even if it is
+// already there, written as a literal or as error followed by a quoted message, and the
+// ".name" directive sets the debug name of the function to a quoted string.
+//
+// A function can only refer to functions declared before it, and the last function of
+// the source is the entry point. The function names, unless set by ".name", and the
+// source position of every instruction are kept as debug info.
+func Assemble(r io.Reader) (*FuncProto, error) {
+	a := &assembler{protos: make(map[string]*FuncProto)}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		a.line++
+		toks, err := a.scan(scanner.Text())
+		if err != nil {
+			return nil, err
+		}
+		if err := a.assembleLine(toks); err != nil {
+			return nil, err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if a.fn != nil {
+		return nil, a.errorf(asmToken{col: 1}, "function %s is not closed by .end", a.fn.name)
+	}
+	if a.entry == nil {
+		return nil, a.errorf(asmToken{col: 1}, "no function declared")
+	}
+	return a.entry, nil
+}
+
+type asmTokenKind uint8
+
+const (
+	asmWord asmTokenKind = iota
+	asmString
+	asmColon
+	asmComma
+)
+
+type asmToken struct {
+	kind asmTokenKind
+	text string
+	col  int
+}
+
+type asmLabel struct {
+	label  FuncProtoLabel
+	marked bool
+	ref    asmToken
+	line   int
+}
+
+type asmFunc struct {
+	name    string
+	builder *FuncProtoBuilder
+	labels  map[string]*asmLabel
+	order   []string
+}
+
+type assembler struct {
+	line   int
+	protos map[string]*FuncProto
+	entry  *FuncProto
+	fn     *asmFunc
+}
+
+func (a *assembler) errorf(tok asmToken, format string, args ...any) error {
+	return &AssemblyError{Line: a.line, Column: tok.col, Err: fmt.Errorf("%w: %s", ErrInvalidProgram, fmt.Sprintf(format, args...))}
+}
+
+func (a *assembler) scan(line string) ([]asmToken, error) {
+	var toks []asmToken
+	for i := 0; i < len(line); {
+		c := line[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case c == ';':
+			return toks, nil
+		case c == ':':
+			toks = append(toks, asmToken{kind: asmColon, text: ":", col: i + 1})
+			i++
+		case c == ',':
+			toks = append(toks, asmToken{kind: asmComma, text: ",", col: i + 1})
+			i++
+		case c == '"':
+			j := i + 1
+			for j < len(line) && line[j] != '"' {
+				if line[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(line) {
+				return nil, a.errorf(asmToken{col: i + 1}, "unterminated string")
+			}
+			toks = append(toks, asmToken{kind: asmString, text: line[i : j+1], col: i + 1})
+			i = j + 1
+		default:
+			j := i
+			for j < len(line) && !strings.ContainsRune(" \t\r;:,\"", rune(line[j])) {
+				j++
+			}
+			toks = append(toks, asmToken{kind: asmWord, text: line[i:j], col: i + 1})
+			i = j
+		}
+	}
+	return toks, nil
+}
+
+func (a *assembler) assembleLine(toks []asmToken) error {
+	if len(toks) == 0 {
+		return nil
+	}
+	if toks[0].kind == asmWord && strings.HasPrefix(toks[0].text, ".") {
+		return a.directive(toks)
+	}
+	if a.fn == nil {
+		return a.errorf(toks[0], "instruction outside of function")
+	}
+	if len(toks) >= 2 && toks[0].kind == asmWord && toks[1].kind == asmColon {
+		if err := a.markLabel(toks[0]); err != nil {
+			return err
+		}
+		toks = toks[2:]
+		if len(toks) == 0 {
+			return nil
+		}
+	}
+	return a.instruction(toks)
+}
+
+func (a *assembler) directive(toks []asmToken) error {
+	switch toks[0].text {
+	case ".func":
+		if a.fn != nil {
+			return a.errorf(toks[0], "function %s is not closed by .end", a.fn.name)
+		}
+		if len(toks) != 3 || toks[1].kind != asmWord || toks[2].kind != asmWord {
+			return a.errorf(toks[0], "expected .func name nargs")
+		}
+		name := toks[1].text
+		if _, ok := a.protos[name]; ok {
+			return a.errorf(toks[1], "function %s already declared", name)
+		}
+		if isAsmKeyword(name) {
+			return a.errorf(toks[1], "invalid function name %s", name)
+		}
+		nargs, err := strconv.ParseUint(toks[2].text, 0, 16)
+		if err != nil {
+			return a.errorf(toks[2], "invalid argument count %s", toks[2].text)
+		}
+		a.fn = &asmFunc{
+			name:    name,
+			builder: &FuncProtoBuilder{nargs: int(nargs)},
+			labels:  make(map[string]*asmLabel),
+		}
+		a.fn.builder.SetName(name)
+		return nil
+	case ".locals":
+		if a.fn == nil {
+			return a.errorf(toks[0], "directive outside of function")
+		}
+		if len(toks) != 2 || toks[1].kind != asmWord {
+			return a.errorf(toks[0], "expected .locals count")
+		}
+		n, err := strconv.ParseUint(toks[1].text, 0, 16)
+		if err != nil {
+			return a.errorf(toks[1], "invalid local count %s", toks[1].text)
+		}
+		for range n {
+			a.fn.builder.NewLocal("")
+		}
+		return nil
+	case ".variadic":
+		if a.fn == nil {
+			return a.errorf(toks[0], "directive outside of function")
+		}
+		if len(toks) != 1 {
+			return a.errorf(toks[0], "expected .variadic")
+		}
+		a.fn.builder.SetVariadic()
+		return nil
+	case ".results":
+		if a.fn == nil {
+			return a.errorf(toks[0], "directive outside of function")
+		}
+		if len(toks) != 2 || toks[1].kind != asmWord {
+			return a.errorf(toks[0], "expected .results count")
+		}
+		n, err := strconv.ParseUint(toks[1].text, 0, 16)
+		if err != nil {
+			return a.errorf(toks[1], "invalid result count %s", toks[1].text)
+		}
+		a.fn.builder.SetResults(int(n))
+		return nil
+	case ".paramtypes", ".resulttypes":
+		if a.fn == nil {
+			return a.errorf(toks[0], "directive outside of function")
+		}
+		types := make([]typeTag, 0, len(toks)-1)
+		for _, tok := range toks[1:] {
+			t, ok := a.typeTag(tok)
+			if !ok {
+				return a.errorf(tok, "unknown type %s", tok.text)
+			}
+			types = append(types, t)
+		}
+		if toks[0].text == ".resulttypes" {
+			a.fn.builder.SetResultTypes(types...)
+		} else if len(types) != a.fn.builder.nargs {
+			return a.errorf(toks[0], "expected %d parameter types, got %d", a.fn.builder.nargs, len(types))
+		} else {
+			a.fn.builder.SetParamTypes(types...)
+		}
+		return nil
+	case ".upval":
+		if a.fn == nil {
+			return a.errorf(toks[0], "directive outside of function")
+		}
+		if len(toks) != 3 || toks[1].kind != asmWord || toks[2].kind != asmWord {
+			return a.errorf(toks[0], "expected .upval local|upval index")
+		}
+		idx, err := strconv.ParseUint(toks[2].text, 0, 31)
+		if err != nil {
+			return a.errorf(toks[2], "invalid upvalue index %s", toks[2].text)
+		}
+		switch toks[1].text {
+		case "local":
+			a.fn.builder.CaptureLocal(int(idx))
+		case "upval":
+			a.fn.builder.CaptureUpvalue(int(idx))
+		default:
+			return a.errorf(toks[1], "expected local or upval, got %s", toks[1].text)
+		}
+		return nil
+	case ".handler":
+		if a.fn == nil {
+			return a.errorf(toks[0], "directive outside of function")
+		}
+		if len(toks) != 4 || toks[1].kind != asmWord || toks[2].kind != asmWord || toks[3].kind != asmWord {
+			return a.errorf(toks[0], "expected .handler start end target")
+		}
+		start, end, target := a.label(toks[1]), a.label(toks[2]), a.label(toks[3])
+		a.fn.builder.AddHandler(start.label, end.label, target.label)
+		return nil
+	case ".name":
+		if a.fn == nil {
+			return a.errorf(toks[0], "directive outside of function")
+		}
+		if len(toks) != 2 || toks[1].kind != asmString {
+			return a.errorf(toks[0], "expected .name \"name\"")
+		}
+		name, err := strconv.Unquote(toks[1].text)
+		if err != nil {
+			return a.errorf(toks[1], "invalid string %s", toks[1].text)
+		}
+		a.fn.builder.SetName(name)
+		return nil
+	case ".const":
+		if a.fn == nil {
+			return a.errorf(toks[0], "directive outside of function")
+		}
+		var v Value
+		switch {
+		case len(toks) == 2:
+			var err error
+			if v, err = a.literal(toks[1], false); err != nil {
+				return err
+			}
+		case len(toks) == 3 && toks[1].kind == asmWord && toks[1].text == "error" && toks[2].kind == asmString:
+			msg, err := strconv.Unquote(toks[2].text)
+			if err != nil {
+				return a.errorf(toks[2], "invalid string %s", toks[2].text)
+			}
+			v = NewError(errors.New(msg))
+		default:
+			return a.errorf(toks[0], "expected .const literal or .const error \"message\"")
+		}
+		a.fn.builder.appendConst(v)
+		return nil
+	case ".end":
+		if a.fn == nil {
+			return a.errorf(toks[0], ".end outside of function")
+		}
+		if len(toks) != 1 {
+			return a.errorf(toks[1], "unexpected %s", toks[1].text)
+		}
+		return a.endFunc(toks[0])
+	default:
+		return a.errorf(toks[0], "unknown directive %s", toks[0].text)
+	}
+}
+
+// endFunc builds the current function, reporting its errors at the given .end token.
+func (a *assembler) endFunc(end asmToken) error {
+	for _, name := range a.fn.order {
+		if l := a.fn.labels[name]; !l.marked {
+			a.line = l.line
+			return a.errorf(l.ref, "undefined label %s", name)
+		}
+	}
+	proto, err := a.fn.builder.build()
+	if err != nil {
+		return &AssemblyError{Line: a.line, Column: end.col, Err: err}
+	}
+	a.protos[a.fn.name] = proto
+	a.entry = proto
+	a.fn = nil
+	return nil
+}
+
+func (a *assembler) label(tok asmToken) *asmLabel {
+	l, ok := a.fn.labels[tok.text]
+	if !ok {
+		l = &asmLabel{label: a.fn.builder.NewLabel(), ref: tok, line: a.line}
+		a.fn.labels[tok.text] = l
+		a.fn.order = append(a.fn.order, tok.text)
+	}
+	return l
+}
+
+func (a *assembler) markLabel(tok asmToken) error {
+	l := a.label(tok)
+	if l.marked {
+		return a.errorf(tok, "label %s already defined", tok.text)
+	}
+	a.fn.builder.Mark(l.label)
+	l.marked = true
+	return nil
+}
+
+func (a *assembler) instruction(toks []asmToken) error {
+	mnemonic := toks[0]
+	if mnemonic.kind != asmWord {
+		return a.errorf(mnemonic, "expected mnemonic, got %s", mnemonic.text)
+	}
+	op, ok := opCodes[strings.ToUpper(mnemonic.text)]
+	if !ok {
+		return a.errorf(mnemonic, "unknown mnemonic %s", mnemonic.text)
+	}
+	operands, err := a.operands(toks[1:])
+	if err != nil {
+		return err
+	}
+
+	kind := opInfos[op].operand
+	want := 1
+	switch kind {
+	case operandNone:
+		want = 0
+	case operandCall:
+		want = 2
+	}
+	if len(operands) != want {
+		return a.errorf(mnemonic, "%s expects %d operands, got %d", opInfos[op].mnemonic, want, len(operands))
+	}
+
+	b := a.fn.builder
+	b.SetPosition(Position{Line: a.line, Column: mnemonic.col})
+	inst := makeInst(op)
+	switch kind {
+	case operandInt:
+		v, err := strconv.ParseInt(operands[0].text, 0, 32)
+		if err != nil || operands[0].kind != asmWord {
+			return a.errorf(operands[0], "invalid integer %s", operands[0].text)
+		}
+		inst = inst.withOpInt(int32(v))
+	case operandFloat:
+		v, err := strconv.ParseFloat(operands[0].text, 32)
+		if err != nil || operands[0].kind != asmWord {
+			return a.errorf(operands[0], "invalid float %s", operands[0].text)
+		}
+		inst = inst.withOpFloat(float32(v))
+	case operandInstPtr:
+		if operands[0].kind != asmWord {
+			return a.errorf(operands[0], "invalid jump target %s", operands[0].text)
+		}
+		if v, err := strconv.ParseUint(operands[0].text, 0, 32); err == nil {
+			inst = inst.withOpInstPtr(InstPtr(v))
+			break
+		}
+		l := a.label(operands[0])
+		if op == opBr {
+			b.EmitBranch(l.label)
+		} else {
+			b.EmitJump(l.label)
+		}
+		return nil
+	case operandConst:
+		k, err := a.constant(operands[0], op == opClosure)
+		if err != nil {
+			return err
+		}
+		inst = inst.withOpInt(int32(k))
+	case operandCall:
+		var counts [2]uint16
+		for i, operand := range operands {
+			v, err := strconv.ParseUint(operand.text, 0, 16)
+			if err != nil || operand.kind != asmWord {
+				return a.errorf(operand, "invalid count %s", operand.text)
+			}
+			counts[i] = uint16(v)
+		}
+		inst = inst.withOpInt(int32(counts[0])).withOpB(counts[1])
+	}
+	b.Emit(inst)
+	return nil
+}
+
+func (a *assembler) operands(toks []asmToken) ([]asmToken, error) {
+	var operands []asmToken
+	for i, tok := range toks {
+		if i%2 == 1 {
+			if tok.kind != asmComma {
+				return nil, a.errorf(tok, "expected comma, got %s", tok.text)
+			}
+			continue
+		}
+		if tok.kind == asmComma || tok.kind == asmColon {
+			return nil, a.errorf(tok, "expected operand, got %s", tok.text)
+		}
+		operands = append(operands, tok)
+	}
+	if len(toks) > 0 && len(toks)%2 == 0 {
+		last := toks[len(toks)-1]
+		return nil, a.errorf(last, "expected operand after %s", last.text)
+	}
+	return operands, nil
+}
+
+// constant adds the constant literal of the token to the constant pool of the current
+// function and returns its index. A '#' followed by an index refers to a constant already
+// in the pool. If onlyFunc is set, the literal must be a function name.
+func (a *assembler) constant(tok asmToken, onlyFunc bool) (int, error) {
+	b := a.fn.builder
+	if text, ok := strings.CutPrefix(tok.text, "#"); ok && tok.kind == asmWord {
+		k, err := strconv.ParseUint(text, 10, 31)
+		if err != nil || int(k) >= len(b.constPool) {
+			return 0, a.errorf(tok, "constant %s out of range", tok.text)
+		}
+		return int(k), nil
+	}
+	v, err := a.literal(tok, onlyFunc)
+	if err != nil {
+		return 0, err
+	}
+	return b.AddConst(v), nil
+}
+
+// literal parses the constant literal of the token. If onlyFunc is set, the literal must
+// be a function name.
+func (a *assembler) literal(tok asmToken, onlyFunc bool) (Value, error) {
+	if proto, ok := a.protos[tok.text]; ok && tok.kind == asmWord {
+		return newValue(TypeFunction, &Function{proto: proto}), nil
+	}
+	if onlyFunc {
+		return NoValue, a.errorf(tok, "unknown function %s", tok.text)
+	}
+	if tok.kind == asmString {
+		s, err := strconv.Unquote(tok.text)
+		if err != nil {
+			return NoValue, a.errorf(tok, "invalid string %s", tok.text)
+		}
+		return NewString(s), nil
+	}
+	switch tok.text {
+	case "none":
+		return NoValue, nil
+	case "true":
+		return NewBool(true), nil
+	case "false":
+		return NewBool(false), nil
+	}
+	if text, ok := strings.CutSuffix(tok.text, "L"); ok {
+		if v, err := strconv.ParseInt(text, 0, 64); err == nil {
+			return NewInt64(v), nil
+		}
+	}
+	if text, ok := strings.CutSuffix(tok.text, "D"); ok {
+		if v, err := strconv.ParseFloat(text, 64); err == nil {
+			return NewFloat64(v), nil
+		}
+	}
+	if v, err := strconv.ParseInt(tok.text, 0, 32); err == nil {
+		return NewInt(int32(v)), nil
+	} else if _, ok := new(big.Int).SetString(tok.text, 0); ok {
+		return NoValue, a.errorf(tok, "integer constant %s out of range, use the L suffix for 64-bit integers", tok.text)
+	}
+	if v, err := strconv.ParseFloat(tok.text, 32); err == nil {
+		return NewFloat(float32(v)), nil
+	}
+	return NoValue, a.errorf(tok, "invalid constant %s", tok.text)
+}
+
+// typeTag parses a type name, as printed by asmTypeName.
+func (a *assembler) typeTag(tok asmToken) (typeTag, bool) {
+	if tok.kind != asmWord {
+		return 0, false
+	}
+	for t := range typeNames {
+		if asmTypeName(t) == tok.text {
+			return t, true
+		}
+	}
+	return 0, false
+}
+
+func isAsmKeyword(name string) bool {
+	switch name {
+	case "none", "true", "false":
+		return true
+	}
+	if strings.HasPrefix(name, "#") {
+		return true
+	}
+	name = strings.TrimSuffix(strings.TrimSuffix(name, "L"), "D")
+	_, err := strconv.ParseFloat(name, 64)
+	return err == nil
+}
+
+// isAsmName reports whether a function name can be written in assembly language as is.
+func isAsmName(name string) bool {
+	if name == "" || isAsmKeyword(name) {
+		return false
+	}
+	return !strings.ContainsFunc(name, func(r rune) bool {
+		return !unicode.IsGraphic(r) || unicode.IsSpace(r) || strings.ContainsRune(";:,\"", r)
+	})
+}
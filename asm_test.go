@@ -0,0 +1,141 @@
+package stackvm_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/apoloval/stackvm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAssemble(t *testing.T) {
+	src := `
+; max(a, b: int) -> int
+.func max 2
+	DUP 0
+	DUP 1
+	GTI
+	BR first
+	DUP 1
+	RET 1
+first:	DUP 0
+	RET 1
+.end
+
+; add(x: int) -> int, adds the captured max to x
+.func add 1
+.upval local 2
+	GETUPVAL 0
+	DUP 0
+	ADDI
+	RET 1
+.end
+
+.func main 2             ; main(a, b: int) -> (int, string)
+.results 2
+	DUP 0
+	DUP 1
+	PUSHK max
+	CALL 2, 1
+	CLOSURE add           ; captures max(a, b)
+	PUSHI -1
+	DUP 3
+	CALL 1, 1
+	PUSHK "max-1"
+	RET 2
+.end
+`
+	proto, err := stackvm.Assemble(strings.NewReader(src))
+	require.NoError(t, err)
+
+	values, err := stackvm.New().Run(proto, stackvm.NewInt(3), stackvm.NewInt(8))
+	require.NoError(t, err)
+	assert.Equal(t, []stackvm.Value{stackvm.NewInt(7), stackvm.NewString("max-1")}, values)
+}
+
+func TestAssemble_Errors(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		src  string
+		line int
+		col  int
+	}{
+		{
+			name: "unknown mnemonic",
+			src:  ".func main 0\n\tFOO 1\n.end\n",
+			line: 2, col: 2,
+		},
+		{
+			name: "missing operand",
+			src:  ".func main 0\n\tPUSHI\n.end\n",
+			line: 2, col: 2,
+		},
+		{
+			name: "invalid integer",
+			src:  ".func main 0\n\tPUSHI abc\n.end\n",
+			line: 2, col: 8,
+		},
+		{
+			name: "integer constant out of range",
+			src:  ".func main 0\n\tPUSHK 3000000000\n\tRET 1\n.end\n",
+			line: 2, col: 8,
+		},
+		{
+			name: "undefined label",
+			src:  ".func main 0\n\tJMP end\n\tRET 0\n.end\n",
+			line: 2, col: 6,
+		},
+		{
+			name: "duplicated label",
+			src:  ".func main 0\nl:\nl:\n\tRET 0\n.end\n",
+			line: 3, col: 1,
+		},
+		{
+			name: "unterminated string",
+			src:  ".func main 0\n\tPUSHK \"abc\n.end\n",
+			line: 2, col: 8,
+		},
+		{
+			name: "unknown function",
+			src:  ".func main 0\n\tCLOSURE foo\n.end\n",
+			line: 2, col: 10,
+		},
+		{
+			name: "constant index out of range",
+			src:  ".func main 0\n.const 1\n\tPUSHK #1\n\tRET 1\n.end\n",
+			line: 3, col: 8,
+		},
+		{
+			name: "invalid constant directive",
+			src:  ".func main 0\n.const error boom\n\tRET 0\n.end\n",
+			line: 2, col: 1,
+		},
+		{
+			name: "invalid function",
+			src:  ".func main 0\n.resulttypes int\n.results 2\n\tRET 2\n.end\n",
+			line: 5, col: 1,
+		},
+		{
+			name: "instruction outside function",
+			src:  "\tRET 0\n",
+			line: 1, col: 2,
+		},
+		{
+			name: "unclosed function",
+			src:  ".func main 0\n\tRET 0\n",
+			line: 2, col: 1,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := stackvm.Assemble(strings.NewReader(test.src))
+			require.ErrorIs(t, err, stackvm.ErrInvalidProgram)
+			var asmErr *stackvm.AssemblyError
+			require.ErrorAs(t, err, &asmErr)
+			assert.Equal(t, test.line, asmErr.Line, asmErr.Error())
+			assert.Equal(t, test.col, asmErr.Column, asmErr.Error())
+			assert.True(t, strings.HasPrefix(err.Error(), fmt.Sprintf("%d:%d: %s: ", test.line, test.col, stackvm.ErrInvalidProgram)), err.Error())
+		})
+	}
+}
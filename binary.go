@@ -0,0 +1,471 @@
+package stackvm
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"math"
+)
+
+// The binary format of a function prototype is laid out as follows:
+//
+//	magic    [4]byte  "SVMB"
+//	version  uint16   bytecode format version
+//	proto    ...      function prototype (see below)
+//	checksum uint32   CRC-32 (IEEE) of all the preceding bytes
+//
+// A prototype is encoded as its number of arguments and locals, whether it is variadic,
+// its declared number of results if any, its declared parameter and result types if any,
+// its upvalue descriptors, its constant pool, its bytecode, its exception handlers and
+// its debug info (name and source positions). Nested prototypes are encoded in place as
+// function constants. Counts are encoded as unsigned varints, fixed-size values in little
+// endian.
+const (
+	binaryMagic   = "SVMB"
+	binaryVersion = 7
+
+	maxProtoDepth = 64
+)
+
+// MarshalBinary encodes the function prototype in the binary bytecode format.
+func (p *FuncProto) MarshalBinary() ([]byte, error) {
+	var e encoder
+	e.buf.WriteString(binaryMagic)
+	e.uint16(binaryVersion)
+	if err := e.proto(p); err != nil {
+		return nil, err
+	}
+	e.uint32(crc32.ChecksumIEEE(e.buf.Bytes()))
+	return e.buf.Bytes(), nil
+}
+
+// UnmarshalBinary decodes a function prototype encoded in the binary bytecode format.
+// It returns ErrInvalidProgram if the data is corrupted or its version is not supported.
+func (p *FuncProto) UnmarshalBinary(data []byte) error {
+	header := len(binaryMagic) + 2
+	if len(data) < header+4 || string(data[:len(binaryMagic)]) != binaryMagic {
+		return fmt.Errorf("%w: bad magic number", ErrInvalidProgram)
+	}
+	if v := binary.LittleEndian.Uint16(data[len(binaryMagic):]); v != binaryVersion {
+		return fmt.Errorf("%w: unsupported bytecode version %d", ErrInvalidProgram, v)
+	}
+	body, sum := data[:len(data)-4], binary.LittleEndian.Uint32(data[len(data)-4:])
+	if crc32.ChecksumIEEE(body) != sum {
+		return fmt.Errorf("%w: checksum mismatch", ErrInvalidProgram)
+	}
+	d := decoder{data: body, pos: header}
+	proto, err := d.proto(0)
+	if err != nil {
+		return err
+	}
+	if d.pos != len(d.data) {
+		return fmt.Errorf("%w: trailing data", ErrInvalidProgram)
+	}
+	*p = *proto
+	return nil
+}
+
+type encoder struct {
+	buf       bytes.Buffer
+	hostNames bool // whether host function constants are encoded by name
+}
+
+func (e *encoder) uint16(v uint16) {
+	e.buf.Write(binary.LittleEndian.AppendUint16(nil, v))
+}
+
+func (e *encoder) uint32(v uint32) {
+	e.buf.Write(binary.LittleEndian.AppendUint32(nil, v))
+}
+
+func (e *encoder) uint64(v uint64) {
+	e.buf.Write(binary.LittleEndian.AppendUint64(nil, v))
+}
+
+func (e *encoder) uvarint(v int) {
+	e.buf.Write(binary.AppendUvarint(nil, uint64(v)))
+}
+
+func (e *encoder) bool(v bool) {
+	if v {
+		e.buf.WriteByte(1)
+	} else {
+		e.buf.WriteByte(0)
+	}
+}
+
+func (e *encoder) types(types []typeTag) {
+	e.uvarint(len(types))
+	for _, t := range types {
+		e.buf.WriteByte(byte(t))
+	}
+}
+
+func (e *encoder) proto(p *FuncProto) error {
+	e.uvarint(p.nargs)
+	e.uvarint(p.nlocals)
+	e.bool(p.variadic)
+	e.bool(p.hasResults)
+	if p.hasResults {
+		e.uvarint(p.nresults)
+	}
+	e.types(p.paramTypes)
+	e.types(p.resultTypes)
+	e.uvarint(len(p.upvals))
+	for _, uv := range p.upvals {
+		e.bool(uv.local)
+		e.uvarint(uv.index)
+	}
+	e.uvarint(len(p.constPool))
+	for _, k := range p.constPool {
+		if err := e.value(k); err != nil {
+			return err
+		}
+	}
+	e.uvarint(len(p.bytecode))
+	for _, inst := range p.bytecode {
+		e.uint64(uint64(inst))
+	}
+	e.uvarint(len(p.handlers))
+	for _, h := range p.handlers {
+		e.uvarint(int(h.start))
+		e.uvarint(int(h.end))
+		e.uvarint(int(h.target))
+		e.uvarint(h.height)
+	}
+	e.uvarint(len(p.name))
+	e.buf.WriteString(p.name)
+	e.uvarint(len(p.positions))
+	for _, pos := range p.positions {
+		e.uvarint(pos.Line)
+		e.uvarint(pos.Column)
+	}
+	return nil
+}
+
+func (e *encoder) value(v Value) error {
+	e.buf.WriteByte(byte(v.t))
+	switch v.t {
+	case TypeNone:
+	case TypeInt:
+		e.uint32(uint32(v.v.(int32)))
+	case TypeFloat:
+		e.uint32(math.Float32bits(v.v.(float32)))
+	case TypeInt64:
+		e.uint64(uint64(v.v.(int64)))
+	case TypeFloat64:
+		e.uint64(math.Float64bits(v.v.(float64)))
+	case TypeBool:
+		e.bool(v.v.(bool))
+	case TypeString:
+		s := v.v.(string)
+		e.uvarint(len(s))
+		e.buf.WriteString(s)
+	case TypeFunction:
+		fn := v.v.(*Function)
+		if len(fn.upvals) > 0 {
+			return fmt.Errorf("%w: cannot encode closure constant", ErrInvalidProgram)
+		}
+		return e.proto(fn.proto)
+	case TypeHostFunction:
+		if !e.hostNames {
+			return fmt.Errorf("%w: cannot encode host function constant", ErrInvalidProgram)
+		}
+		name := v.v.(*HostFunction).name
+		e.uvarint(len(name))
+		e.buf.WriteString(name)
+	default:
+		return fmt.Errorf("%w: cannot encode %s constant", ErrInvalidProgram, typeNames[v.t])
+	}
+	return nil
+}
+
+// hash returns the content hash of the function prototype. It covers the same content as
+// the binary format, except that host function constants are identified by name.
+func (p *FuncProto) hash() ([sha256.Size]byte, error) {
+	e := encoder{hostNames: true}
+	if err := e.proto(p); err != nil {
+		return [sha256.Size]byte{}, err
+	}
+	return sha256.Sum256(e.buf.Bytes()), nil
+}
+
+type decoder struct {
+	data []byte
+	pos  int
+	kind error // the error wrapped by decoding errors, ErrInvalidProgram if nil
+}
+
+func (d *decoder) errorf(format string, args ...any) error {
+	kind := d.kind
+	if kind == nil {
+		kind = ErrInvalidProgram
+	}
+	return fmt.Errorf("%w: %s", kind, fmt.Sprintf(format, args...))
+}
+
+func (d *decoder) errTruncated() error {
+	return d.errorf("unexpected end of data")
+}
+
+func (d *decoder) bytes(n int) ([]byte, error) {
+	if n < 0 || n > len(d.data)-d.pos {
+		return nil, d.errTruncated()
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+func (d *decoder) byte() (byte, error) {
+	b, err := d.bytes(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+func (d *decoder) uint32() (uint32, error) {
+	b, err := d.bytes(4)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(b), nil
+}
+
+func (d *decoder) uint64() (uint64, error) {
+	b, err := d.bytes(8)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(b), nil
+}
+
+func (d *decoder) bool() (bool, error) {
+	b, err := d.byte()
+	if err != nil {
+		return false, err
+	}
+	if b > 1 {
+		return false, d.errorf("invalid boolean %d", b)
+	}
+	return b == 1, nil
+}
+
+func (d *decoder) uvarint() (int, error) {
+	v, n := binary.Uvarint(d.data[d.pos:])
+	if n <= 0 {
+		return 0, d.errTruncated()
+	}
+	if v > math.MaxInt32 {
+		return 0, d.errorf("value %d out of range", v)
+	}
+	d.pos += n
+	return int(v), nil
+}
+
+// count decodes the number of items that follow. It cannot exceed the remaining bytes,
+// since every item takes at least one byte.
+func (d *decoder) count() (int, error) {
+	v, err := d.uvarint()
+	if err != nil {
+		return 0, err
+	}
+	if v > len(d.data)-d.pos {
+		return 0, d.errTruncated()
+	}
+	return v, nil
+}
+
+// types decodes a list of type tags, returning nil if empty.
+func (d *decoder) types() ([]typeTag, error) {
+	n, err := d.count()
+	if err != nil || n == 0 {
+		return nil, err
+	}
+	types := make([]typeTag, n)
+	for i := range types {
+		b, err := d.byte()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := typeNames[typeTag(b)]; !ok {
+			return nil, d.errorf("invalid type tag %d", b)
+		}
+		types[i] = typeTag(b)
+	}
+	return types, nil
+}
+
+func (d *decoder) proto(depth int) (*FuncProto, error) {
+	if depth > maxProtoDepth {
+		return nil, d.errorf("prototypes nested too deep")
+	}
+	var (
+		p   FuncProto
+		err error
+	)
+	if p.nargs, err = d.uvarint(); err != nil {
+		return nil, err
+	}
+	if p.nlocals, err = d.uvarint(); err != nil {
+		return nil, err
+	}
+	if p.variadic, err = d.bool(); err != nil {
+		return nil, err
+	}
+	if p.hasResults, err = d.bool(); err != nil {
+		return nil, err
+	}
+	if p.hasResults {
+		if p.nresults, err = d.uvarint(); err != nil {
+			return nil, err
+		}
+	}
+	if p.paramTypes, err = d.types(); err != nil {
+		return nil, err
+	}
+	if p.paramTypes != nil && len(p.paramTypes) != p.nargs {
+		return nil, d.errorf("%d parameter types for %d arguments", len(p.paramTypes), p.nargs)
+	}
+	if p.resultTypes, err = d.types(); err != nil {
+		return nil, err
+	}
+	if p.resultTypes != nil && (!p.hasResults || len(p.resultTypes) != p.nresults) {
+		return nil, d.errorf("%d result types for %d results", len(p.resultTypes), p.nresults)
+	}
+	nupvals, err := d.count()
+	if err != nil {
+		return nil, err
+	}
+	p.upvals = make([]upvalDesc, nupvals)
+	for i := range p.upvals {
+		if p.upvals[i].local, err = d.bool(); err != nil {
+			return nil, err
+		}
+		if p.upvals[i].index, err = d.uvarint(); err != nil {
+			return nil, err
+		}
+	}
+	nconsts, err := d.count()
+	if err != nil {
+		return nil, err
+	}
+	p.constPool = make([]Value, nconsts)
+	for i := range p.constPool {
+		if p.constPool[i], err = d.value(depth); err != nil {
+			return nil, err
+		}
+	}
+	ncode, err := d.count()
+	if err != nil {
+		return nil, err
+	}
+	p.bytecode = make([]Inst, ncode)
+	for i := range p.bytecode {
+		inst, err := d.uint64()
+		if err != nil {
+			return nil, err
+		}
+		p.bytecode[i] = Inst(inst)
+	}
+	nhandlers, err := d.count()
+	if err != nil {
+		return nil, err
+	}
+	p.handlers = make([]handler, nhandlers)
+	for i := range p.handlers {
+		var fields [4]int
+		for j := range fields {
+			if fields[j], err = d.uvarint(); err != nil {
+				return nil, err
+			}
+		}
+		p.handlers[i] = handler{
+			start:  InstPtr(fields[0]),
+			end:    InstPtr(fields[1]),
+			target: InstPtr(fields[2]),
+			height: fields[3],
+		}
+	}
+	if p.name, err = d.string(); err != nil {
+		return nil, err
+	}
+	npositions, err := d.count()
+	if err != nil {
+		return nil, err
+	}
+	if npositions > 0 {
+		if npositions != len(p.bytecode) {
+			return nil, d.errorf("debug info does not match bytecode")
+		}
+		p.positions = make([]Position, npositions)
+		for i := range p.positions {
+			if p.positions[i].Line, err = d.uvarint(); err != nil {
+				return nil, err
+			}
+			if p.positions[i].Column, err = d.uvarint(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if v, err := verify(&p); err == nil {
+		p.maxStack = v.maxDepth
+		p.verified = true
+	}
+	return &p, nil
+}
+
+func (d *decoder) value(depth int) (Value, error) {
+	tag, err := d.byte()
+	if err != nil {
+		return NoValue, err
+	}
+	if typeTag(tag) == TypeFunction {
+		proto, err := d.proto(depth + 1)
+		if err != nil {
+			return NoValue, err
+		}
+		return newValue(TypeFunction, &Function{proto: proto}), nil
+	}
+	return d.scalar(typeTag(tag))
+}
+
+// scalar decodes a value of the given type that does not refer to other objects.
+func (d *decoder) scalar(tag typeTag) (Value, error) {
+	switch tag {
+	case TypeNone:
+		return NoValue, nil
+	case TypeInt:
+		v, err := d.uint32()
+		return NewInt(int32(v)), err
+	case TypeFloat:
+		v, err := d.uint32()
+		return NewFloat(math.Float32frombits(v)), err
+	case TypeInt64:
+		v, err := d.uint64()
+		return NewInt64(int64(v)), err
+	case TypeFloat64:
+		v, err := d.uint64()
+		return NewFloat64(math.Float64frombits(v)), err
+	case TypeBool:
+		v, err := d.bool()
+		return NewBool(v), err
+	case TypeString:
+		s, err := d.string()
+		return NewString(s), err
+	default:
+		return NoValue, d.errorf("invalid value type %d", tag)
+	}
+}
+
+func (d *decoder) string() (string, error) {
+	n, err := d.count()
+	if err != nil {
+		return "", err
+	}
+	b, err := d.bytes(n)
+	return string(b), err
+}
@@ -0,0 +1,132 @@
+package stackvm_test
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+
+	"github.com/apoloval/stackvm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFuncProto_BinaryRoundTrip(t *testing.T) {
+	// main(x:int) -> string { f := func(y:int) -> bool { return x > y }; if f(5) { return "big" }; return "small" }
+	main, err := stackvm.NewFuncProto(1, func(b *stackvm.FuncProtoBuilder) {
+		gt, err := stackvm.NewFuncProto(1, func(b *stackvm.FuncProtoBuilder) {
+			b.SetParamTypes(stackvm.TypeInt)
+			b.SetResultTypes(stackvm.TypeBool)
+			x := b.CaptureLocal(0)
+			b.Emit(stackvm.GETUPVAL(x))
+			b.Emit(stackvm.DUP(0))
+			b.Emit(stackvm.GTI())
+			b.Emit(stackvm.RET(1))
+		})
+		require.NoError(t, err)
+		b.SetParamTypes(stackvm.TypeInt)
+		b.SetResultTypes(stackvm.TypeString)
+		big := b.NewLabel()
+		b.Emit(stackvm.PUSHI(5))
+		b.Emit(stackvm.CLOSURE(b.AddProto(gt)))
+		b.Emit(stackvm.CALL(1, 1))
+		b.EmitBranch(big)
+		b.Emit(stackvm.PUSHK(b.AddConst(stackvm.NewString("small"))))
+		b.Emit(stackvm.RET(1))
+		b.Mark(big)
+		b.Emit(stackvm.PUSHK(b.AddConst(stackvm.NewString("big"))))
+		b.Emit(stackvm.RET(1))
+	})
+	require.NoError(t, err)
+
+	data, err := main.MarshalBinary()
+	require.NoError(t, err)
+
+	var decoded stackvm.FuncProto
+	require.NoError(t, decoded.UnmarshalBinary(data))
+
+	again, err := decoded.MarshalBinary()
+	require.NoError(t, err)
+	assert.Equal(t, data, again)
+
+	values, err := stackvm.New().Run(&decoded, stackvm.NewInt(7))
+	require.NoError(t, err)
+	assert.Equal(t, []stackvm.Value{stackvm.NewString("big")}, values)
+
+	_, err = stackvm.New().Run(&decoded, stackvm.NewFloat(7))
+	assert.ErrorIs(t, err, stackvm.ErrTypeMismatch)
+}
+
+func TestFuncProto_BinaryWideConstants(t *testing.T) {
+	proto, err := stackvm.NewFuncProto(0, func(b *stackvm.FuncProtoBuilder) {
+		b.Emit(stackvm.PUSHK(b.AddConst(stackvm.NewInt64(-1 << 40))))
+		b.Emit(stackvm.PUSHK(b.AddConst(stackvm.NewFloat64(1e300))))
+		b.Emit(stackvm.RET(2))
+	})
+	require.NoError(t, err)
+	data, err := proto.MarshalBinary()
+	require.NoError(t, err)
+
+	var decoded stackvm.FuncProto
+	require.NoError(t, decoded.UnmarshalBinary(data))
+	values, err := stackvm.New().Run(&decoded)
+	require.NoError(t, err)
+	assert.Equal(t, []stackvm.Value{stackvm.NewInt64(-1 << 40), stackvm.NewFloat64(1e300)}, values)
+}
+
+func TestFuncProto_UnmarshalBinaryInvalid(t *testing.T) {
+	proto, err := stackvm.NewFuncProto(0, func(b *stackvm.FuncProtoBuilder) {
+		b.Emit(stackvm.PUSHK(b.AddConst(stackvm.NewString("hello"))))
+		b.Emit(stackvm.RET(1))
+	})
+	require.NoError(t, err)
+	data, err := proto.MarshalBinary()
+	require.NoError(t, err)
+
+	resign := func(data []byte) []byte {
+		body := data[:len(data)-4]
+		return binary.LittleEndian.AppendUint32(body, crc32.ChecksumIEEE(body))
+	}
+
+	for _, test := range []struct {
+		name   string
+		mutate func(data []byte) []byte
+	}{
+		{
+			name:   "empty",
+			mutate: func(data []byte) []byte { return nil },
+		},
+		{
+			name: "bad magic",
+			mutate: func(data []byte) []byte {
+				data[0] = 'X'
+				return data
+			},
+		},
+		{
+			name: "unsupported version",
+			mutate: func(data []byte) []byte {
+				data[4] = 0xFF
+				return resign(data)
+			},
+		},
+		{
+			name: "corrupted",
+			mutate: func(data []byte) []byte {
+				data[10] ^= 0xFF
+				return data
+			},
+		},
+		{
+			name: "truncated",
+			mutate: func(data []byte) []byte {
+				return resign(data[:len(data)-8])
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			input := test.mutate(append([]byte(nil), data...))
+			var decoded stackvm.FuncProto
+			assert.ErrorIs(t, decoded.UnmarshalBinary(input), stackvm.ErrInvalidProgram)
+		})
+	}
+}
@@ -1,27 +1,46 @@
 package stackvm
 
-import "math"
+import (
+	"fmt"
+	"math"
+)
 
 type opCode uint16
 
 const (
-	typNone   opCode = 0x0 // none type
-	typInt    opCode = 0x1 // integer type
-	typFloat  opCode = 0x2 // float type
-	typBool   opCode = 0x3 // boolean type
-	typString opCode = 0x4 // string type
+	typNone    opCode = 0x0 // none type
+	typInt     opCode = 0x1 // integer type
+	typFloat   opCode = 0x2 // float type
+	typBool    opCode = 0x3 // boolean type
+	typString  opCode = 0x4 // string type
+	typInt64   opCode = 0x5 // 64-bit integer type
+	typFloat64 opCode = 0x6 // 64-bit float type
 
 	// Control flow instructions
-	opNop opCode = 0x0000 // NOP: no operation
-	opBr  opCode = 0x0010 // BR: branch (conditional)
-	opJmp opCode = 0x0020 // JMP: jump
-	opRet opCode = 0x0030 // RET: return from function
+	opNop   opCode = 0x0000 // NOP: no operation
+	opBr    opCode = 0x0010 // BR: branch (conditional)
+	opJmp   opCode = 0x0020 // JMP: jump
+	opRet   opCode = 0x0030 // RET: return from function
+	opRetv  opCode = 0x0090 // RETV: return variable number of values
+	opCall  opCode = 0x0040 // CALL: call function
+	opThrow opCode = 0x0050 // THROW: throw exception
+
+	// Coroutine instructions
+	opCoroutine opCode = 0x0060 // COROUTINE: create coroutine
+	opResume    opCode = 0x0070 // RESUME: resume coroutine
+	opYield     opCode = 0x0080 // YIELD: yield from coroutine
 
 	// Stack handling instructions
 	opDup   opCode = 0x0100            // DUP: duplicate value
 	opPushi opCode = 0x0110 | typInt   // PUSHI: push integer value
 	opPushf opCode = 0x0110 | typFloat // PUSHF: push float value
 	opPop   opCode = 0x0120            // POP: pop value
+	opPushk opCode = 0x0130            // PUSHK: push constant value
+	opLoad  opCode = 0x0140            // LOAD: push variable slot
+	opStore opCode = 0x0150            // STORE: pop value into variable slot
+
+	opVararg  opCode = 0x0160 // VARARG: push extra argument
+	opVarargn opCode = 0x0170 // VARARGN: push number of extra arguments
 
 	// Arithmetic-logical instructions
 	opAddi opCode = 0x0200 | typInt   // ADDI: add integer values
@@ -36,6 +55,23 @@ const (
 	opNegi opCode = 0x0250 | typInt   // NEGI: negate integer values
 	opNegf opCode = 0x0250 | typFloat // NEGF: negate float values
 
+	opAddic opCode = 0x0260 | typInt // ADDIC: add integer values, trapping on overflow
+	opSubic opCode = 0x0270 | typInt // SUBIC: subtract integer values, trapping on overflow
+	opMulic opCode = 0x0280 | typInt // MULIC: multiply integer values, trapping on overflow
+	opNegic opCode = 0x0290 | typInt // NEGIC: negate integer values, trapping on overflow
+
+	opAddl opCode = 0x0200 | typInt64   // ADDL: add 64-bit integer values
+	opAddd opCode = 0x0200 | typFloat64 // ADDD: add 64-bit float values
+	opSubl opCode = 0x0210 | typInt64   // SUBL: subtract 64-bit integer values
+	opSubd opCode = 0x0210 | typFloat64 // SUBD: subtract 64-bit float values
+	opMull opCode = 0x0220 | typInt64   // MULL: multiply 64-bit integer values
+	opMuld opCode = 0x0220 | typFloat64 // MULD: multiply 64-bit float values
+	opDivl opCode = 0x0230 | typInt64   // DIVL: divide 64-bit integer values
+	opDivd opCode = 0x0230 | typFloat64 // DIVD: divide 64-bit float values
+	opModl opCode = 0x0240 | typInt64   // MODL: modulo 64-bit integer values
+	opNegl opCode = 0x0250 | typInt64   // NEGL: negate 64-bit integer values
+	opNegd opCode = 0x0250 | typFloat64 // NEGD: negate 64-bit float values
+
 	// Evaluation instructions
 	opEqi opCode = 0x0300 | typInt    // EQI: evaluate integers equal to
 	opEqf opCode = 0x0300 | typFloat  // EQF: evaluate floats equal to
@@ -54,15 +90,159 @@ const (
 	opLtf opCode = 0x0340 | typFloat // LTF: evaluate floats less than
 	opLei opCode = 0x0350 | typInt   // LEI: evaluate integers less than or equal to
 	opLef opCode = 0x0350 | typFloat // LEF: evaluate floats less than or equal to
+
+	opEql opCode = 0x0300 | typInt64   // EQL: evaluate 64-bit integers equal to
+	opEqd opCode = 0x0300 | typFloat64 // EQD: evaluate 64-bit floats equal to
+	opNel opCode = 0x0310 | typInt64   // NEL: evaluate 64-bit integers not equal to
+	opNed opCode = 0x0310 | typFloat64 // NED: evaluate 64-bit floats not equal to
+	opGtl opCode = 0x0320 | typInt64   // GTL: evaluate 64-bit integers greater than
+	opGtd opCode = 0x0320 | typFloat64 // GTD: evaluate 64-bit floats greater than
+	opGel opCode = 0x0330 | typInt64   // GEL: evaluate 64-bit integers greater than or equal to
+	opGed opCode = 0x0330 | typFloat64 // GED: evaluate 64-bit floats greater than or equal to
+	opLtl opCode = 0x0340 | typInt64   // LTL: evaluate 64-bit integers less than
+	opLtd opCode = 0x0340 | typFloat64 // LTD: evaluate 64-bit floats less than
+	opLel opCode = 0x0350 | typInt64   // LEL: evaluate 64-bit integers less than or equal to
+	opLed opCode = 0x0350 | typFloat64 // LED: evaluate 64-bit floats less than or equal to
+
+	// Closure instructions
+	opClosure  opCode = 0x0400 // CLOSURE: create closure
+	opGetUpval opCode = 0x0410 // GETUPVAL: push upvalue
+	opSetUpval opCode = 0x0420 // SETUPVAL: pop value into upvalue
+
+	// Global instructions
+	opGetGlobal opCode = 0x0500 // GETGLOBAL: push global variable
+	opSetGlobal opCode = 0x0510 // SETGLOBAL: pop value into global variable
+
+	// Conversion instructions
+	opI2l opCode = 0x0600 // I2L: convert integer to 64-bit integer
+	opL2i opCode = 0x0610 // L2I: convert 64-bit integer to integer
+	opF2d opCode = 0x0620 // F2D: convert float to 64-bit float
+	opD2f opCode = 0x0630 // D2F: convert 64-bit float to float
 )
 
+// operandKind is the kind of argument an instruction takes.
+type operandKind uint8
+
+const (
+	operandNone    operandKind = iota // no argument
+	operandInt                        // integer argument
+	operandFloat                      // float argument
+	operandInstPtr                    // instruction pointer argument
+	operandConst                      // constant pool index argument
+	operandCall                       // argument and result counts
+)
+
+// opInfo describes an operation for assembling, disassembling and verification purposes.
+// The stack effect of operations with variable arity is computed by the verifier.
+type opInfo struct {
+	mnemonic string
+	operand  operandKind
+	pops     int
+	pushes   int
+}
+
+var opInfos = map[opCode]opInfo{
+	opNop:       {"NOP", operandNone, 0, 0},
+	opBr:        {"BR", operandInstPtr, 1, 0},
+	opJmp:       {"JMP", operandInstPtr, 0, 0},
+	opRet:       {"RET", operandInt, 0, 0},
+	opRetv:      {"RETV", operandInt, 0, 0},
+	opCall:      {"CALL", operandCall, 0, 0},
+	opThrow:     {"THROW", operandNone, 1, 0},
+	opCoroutine: {"COROUTINE", operandNone, 1, 1},
+	opResume:    {"RESUME", operandCall, 0, 0},
+	opYield:     {"YIELD", operandCall, 0, 0},
+	opDup:       {"DUP", operandInt, 0, 1},
+	opPushi:     {"PUSHI", operandInt, 0, 1},
+	opPushf:     {"PUSHF", operandFloat, 0, 1},
+	opPop:       {"POP", operandInt, 1, 0},
+	opPushk:     {"PUSHK", operandConst, 0, 1},
+	opLoad:      {"LOAD", operandInt, 0, 1},
+	opStore:     {"STORE", operandInt, 1, 0},
+	opVararg:    {"VARARG", operandNone, 1, 1},
+	opVarargn:   {"VARARGN", operandNone, 0, 1},
+	opAddi:      {"ADDI", operandNone, 2, 1},
+	opAddf:      {"ADDF", operandNone, 2, 1},
+	opSubi:      {"SUBI", operandNone, 2, 1},
+	opSubf:      {"SUBF", operandNone, 2, 1},
+	opMuli:      {"MULI", operandNone, 2, 1},
+	opMulf:      {"MULF", operandNone, 2, 1},
+	opDivi:      {"DIVI", operandNone, 2, 1},
+	opDivf:      {"DIVF", operandNone, 2, 1},
+	opModi:      {"MODI", operandNone, 2, 1},
+	opNegi:      {"NEGI", operandNone, 1, 1},
+	opNegf:      {"NEGF", operandNone, 1, 1},
+	opAddic:     {"ADDIC", operandNone, 2, 1},
+	opSubic:     {"SUBIC", operandNone, 2, 1},
+	opMulic:     {"MULIC", operandNone, 2, 1},
+	opNegic:     {"NEGIC", operandNone, 1, 1},
+	opAddl:      {"ADDL", operandNone, 2, 1},
+	opAddd:      {"ADDD", operandNone, 2, 1},
+	opSubl:      {"SUBL", operandNone, 2, 1},
+	opSubd:      {"SUBD", operandNone, 2, 1},
+	opMull:      {"MULL", operandNone, 2, 1},
+	opMuld:      {"MULD", operandNone, 2, 1},
+	opDivl:      {"DIVL", operandNone, 2, 1},
+	opDivd:      {"DIVD", operandNone, 2, 1},
+	opModl:      {"MODL", operandNone, 2, 1},
+	opNegl:      {"NEGL", operandNone, 1, 1},
+	opNegd:      {"NEGD", operandNone, 1, 1},
+	opEqi:       {"EQI", operandNone, 2, 1},
+	opEqf:       {"EQF", operandNone, 2, 1},
+	opEqb:       {"EQB", operandNone, 2, 1},
+	opEqs:       {"EQS", operandNone, 2, 1},
+	opNei:       {"NEI", operandNone, 2, 1},
+	opNef:       {"NEF", operandNone, 2, 1},
+	opNeb:       {"NEB", operandNone, 2, 1},
+	opNes:       {"NES", operandNone, 2, 1},
+	opGti:       {"GTI", operandNone, 2, 1},
+	opGtf:       {"GTF", operandNone, 2, 1},
+	opGei:       {"GEI", operandNone, 2, 1},
+	opGef:       {"GEF", operandNone, 2, 1},
+	opLti:       {"LTI", operandNone, 2, 1},
+	opLtf:       {"LTF", operandNone, 2, 1},
+	opLei:       {"LEI", operandNone, 2, 1},
+	opLef:       {"LEF", operandNone, 2, 1},
+	opEql:       {"EQL", operandNone, 2, 1},
+	opEqd:       {"EQD", operandNone, 2, 1},
+	opNel:       {"NEL", operandNone, 2, 1},
+	opNed:       {"NED", operandNone, 2, 1},
+	opGtl:       {"GTL", operandNone, 2, 1},
+	opGtd:       {"GTD", operandNone, 2, 1},
+	opGel:       {"GEL", operandNone, 2, 1},
+	opGed:       {"GED", operandNone, 2, 1},
+	opLtl:       {"LTL", operandNone, 2, 1},
+	opLtd:       {"LTD", operandNone, 2, 1},
+	opLel:       {"LEL", operandNone, 2, 1},
+	opLed:       {"LED", operandNone, 2, 1},
+	opClosure:   {"CLOSURE", operandConst, 0, 1},
+	opGetUpval:  {"GETUPVAL", operandInt, 0, 1},
+	opSetUpval:  {"SETUPVAL", operandInt, 1, 0},
+	opGetGlobal: {"GETGLOBAL", operandConst, 0, 1},
+	opSetGlobal: {"SETGLOBAL", operandConst, 1, 0},
+	opI2l:       {"I2L", operandNone, 1, 1},
+	opL2i:       {"L2I", operandNone, 1, 1},
+	opF2d:       {"F2D", operandNone, 1, 1},
+	opD2f:       {"D2F", operandNone, 1, 1},
+}
+
+// opCodes maps mnemonics to their operation codes.
+var opCodes = func() map[string]opCode {
+	m := make(map[string]opCode, len(opInfos))
+	for op, info := range opInfos {
+		m[info.mnemonic] = op
+	}
+	return m
+}()
+
 // InstPtr is the pointer to the instruction.
 type InstPtr uint32
 
 var nullInstPtr InstPtr = ^InstPtr(0)
 
 // Inst is the instruction of the code segment. It is a 64-bit integer that encodes the
-// operation in the first 8 bits and the arguments in the rest.
+// operation in the upper 16 bits, an optional secondary argument in the next 16 bits and
+// the main argument in the lower 32 bits.
 type Inst uint64
 
 // NOP encodes a NOP instruction.
@@ -77,6 +257,35 @@ func JMP(arg InstPtr) Inst { return makeInst(opJmp).withOpInstPtr(arg) }
 // RET encodes a RET instruction.
 func RET(arg uint) Inst { return makeInst(opRet).withOpInt(int32(arg)) }
 
+// RETV encodes a RETV instruction. It returns all the values from the given slot of the
+// frame up to the top of the stack, so RETV 0 returns everything above the frame base.
+func RETV(arg int) Inst { return makeInst(opRetv).withOpInt(int32(arg)) }
+
+// CALL encodes a CALL instruction. The callee is expected on top of the stack, right
+// above its nargs arguments. The callee must return exactly nres values.
+func CALL(nargs, nres uint16) Inst {
+	return makeInst(opCall).withOpInt(int32(nargs)).withOpB(nres)
+}
+
+// THROW encodes a THROW instruction.
+func THROW() Inst { return makeInst(opThrow) }
+
+// COROUTINE encodes a COROUTINE instruction. It pops a function and pushes a new
+// coroutine that executes it.
+func COROUTINE() Inst { return makeInst(opCoroutine) }
+
+// RESUME encodes a RESUME instruction. The coroutine is expected on top of the stack,
+// right above its nargs arguments. The coroutine must yield or return exactly nres values.
+func RESUME(nargs, nres uint16) Inst {
+	return makeInst(opResume).withOpInt(int32(nargs)).withOpB(nres)
+}
+
+// YIELD encodes a YIELD instruction. It suspends the current coroutine, passing n values
+// to its resumer, and expects nres values when it is resumed back.
+func YIELD(n, nres uint16) Inst {
+	return makeInst(opYield).withOpInt(int32(n)).withOpB(nres)
+}
+
 // DUP encodes a DUP instruction.
 func DUP(arg int) Inst { return makeInst(opDup).withOpInt(int32(arg)) }
 
@@ -89,6 +298,26 @@ func PUSHF(arg float32) Inst { return makeInst(opPushf).withOpFloat(arg) }
 // POP encodes a POP instruction.
 func POP(arg int) Inst { return makeInst(opPop).withOpInt(int32(arg)) }
 
+// PUSHK encodes a PUSHK instruction. It pushes the constant at the given index of the
+// constant pool, which is the way to load 64-bit values.
+func PUSHK(arg int) Inst { return makeInst(opPushk).withOpInt(int32(arg)) }
+
+// LOAD encodes a LOAD instruction. It pushes the value of a variable slot, which is an
+// argument or a local of the current frame.
+func LOAD(arg int) Inst { return makeInst(opLoad).withOpInt(int32(arg)) }
+
+// STORE encodes a STORE instruction. It pops a value into a variable slot, which is an
+// argument or a local of the current frame.
+func STORE(arg int) Inst { return makeInst(opStore).withOpInt(int32(arg)) }
+
+// VARARG encodes a VARARG instruction. It pops an index and pushes the extra argument of
+// the current frame at that index.
+func VARARG() Inst { return makeInst(opVararg) }
+
+// VARARGN encodes a VARARGN instruction. It pushes the number of extra arguments of the
+// current frame.
+func VARARGN() Inst { return makeInst(opVarargn) }
+
 // ADDI encodes an ADDI instruction.
 func ADDI() Inst { return makeInst(opAddi) }
 
@@ -104,6 +333,9 @@ func SUBF() Inst { return makeInst(opSubf) }
 // MULI encodes a MULI instruction.
 func MULI() Inst { return makeInst(opMuli) }
 
+// MULF encodes a MULF instruction.
+func MULF() Inst { return makeInst(opMulf) }
+
 // DIVI encodes a DIVI instruction.
 func DIVI() Inst { return makeInst(opDivi) }
 
@@ -119,6 +351,55 @@ func NEGI() Inst { return makeInst(opNegi) }
 // NEGF encodes a NEGF instruction.
 func NEGF() Inst { return makeInst(opNegf) }
 
+// ADDIC encodes an ADDIC instruction. It fails with ErrArithmetic on overflow, regardless
+// of the integer mode.
+func ADDIC() Inst { return makeInst(opAddic) }
+
+// SUBIC encodes a SUBIC instruction. It fails with ErrArithmetic on overflow, regardless
+// of the integer mode.
+func SUBIC() Inst { return makeInst(opSubic) }
+
+// MULIC encodes a MULIC instruction. It fails with ErrArithmetic on overflow, regardless
+// of the integer mode.
+func MULIC() Inst { return makeInst(opMulic) }
+
+// NEGIC encodes a NEGIC instruction. It fails with ErrArithmetic on overflow, regardless
+// of the integer mode.
+func NEGIC() Inst { return makeInst(opNegic) }
+
+// ADDL encodes an ADDL instruction.
+func ADDL() Inst { return makeInst(opAddl) }
+
+// ADDD encodes an ADDD instruction.
+func ADDD() Inst { return makeInst(opAddd) }
+
+// SUBL encodes a SUBL instruction.
+func SUBL() Inst { return makeInst(opSubl) }
+
+// SUBD encodes a SUBD instruction.
+func SUBD() Inst { return makeInst(opSubd) }
+
+// MULL encodes a MULL instruction.
+func MULL() Inst { return makeInst(opMull) }
+
+// MULD encodes a MULD instruction.
+func MULD() Inst { return makeInst(opMuld) }
+
+// DIVL encodes a DIVL instruction.
+func DIVL() Inst { return makeInst(opDivl) }
+
+// DIVD encodes a DIVD instruction.
+func DIVD() Inst { return makeInst(opDivd) }
+
+// MODL encodes a MODL instruction.
+func MODL() Inst { return makeInst(opModl) }
+
+// NEGL encodes a NEGL instruction.
+func NEGL() Inst { return makeInst(opNegl) }
+
+// NEGD encodes a NEGD instruction.
+func NEGD() Inst { return makeInst(opNegd) }
+
 // EQI encodes a EQI instruction.
 func EQI() Inst { return makeInst(opEqi) }
 
@@ -167,12 +448,80 @@ func LEI() Inst { return makeInst(opLei) }
 // LEF encodes a LEF instruction.
 func LEF() Inst { return makeInst(opLef) }
 
+// EQL encodes a EQL instruction.
+func EQL() Inst { return makeInst(opEql) }
+
+// EQD encodes a EQD instruction.
+func EQD() Inst { return makeInst(opEqd) }
+
+// NEL encodes a NEL instruction.
+func NEL() Inst { return makeInst(opNel) }
+
+// NED encodes a NED instruction.
+func NED() Inst { return makeInst(opNed) }
+
+// GTL encodes a GTL instruction.
+func GTL() Inst { return makeInst(opGtl) }
+
+// GTD encodes a GTD instruction.
+func GTD() Inst { return makeInst(opGtd) }
+
+// GEL encodes a GEL instruction.
+func GEL() Inst { return makeInst(opGel) }
+
+// GED encodes a GED instruction.
+func GED() Inst { return makeInst(opGed) }
+
+// LTL encodes a LTL instruction.
+func LTL() Inst { return makeInst(opLtl) }
+
+// LTD encodes a LTD instruction.
+func LTD() Inst { return makeInst(opLtd) }
+
+// LEL encodes a LEL instruction.
+func LEL() Inst { return makeInst(opLel) }
+
+// LED encodes a LED instruction.
+func LED() Inst { return makeInst(opLed) }
+
+// CLOSURE encodes a CLOSURE instruction. The argument is the index of the function
+// prototype in the constant pool.
+func CLOSURE(arg int) Inst { return makeInst(opClosure).withOpInt(int32(arg)) }
+
+// GETUPVAL encodes a GETUPVAL instruction.
+func GETUPVAL(arg int) Inst { return makeInst(opGetUpval).withOpInt(int32(arg)) }
+
+// SETUPVAL encodes a SETUPVAL instruction.
+func SETUPVAL(arg int) Inst { return makeInst(opSetUpval).withOpInt(int32(arg)) }
+
+// GETGLOBAL encodes a GETGLOBAL instruction. The name of the global variable is the string
+// constant at the given index of the constant pool.
+func GETGLOBAL(arg int) Inst { return makeInst(opGetGlobal).withOpInt(int32(arg)) }
+
+// SETGLOBAL encodes a SETGLOBAL instruction. The name of the global variable is the string
+// constant at the given index of the constant pool.
+func SETGLOBAL(arg int) Inst { return makeInst(opSetGlobal).withOpInt(int32(arg)) }
+
+// I2L encodes an I2L instruction. It converts an integer to a 64-bit integer.
+func I2L() Inst { return makeInst(opI2l) }
+
+// L2I encodes a L2I instruction. It converts a 64-bit integer to an integer, which may
+// overflow according to the integer mode.
+func L2I() Inst { return makeInst(opL2i) }
+
+// F2D encodes a F2D instruction. It converts a float to a 64-bit float.
+func F2D() Inst { return makeInst(opF2d) }
+
+// D2F encodes a D2F instruction. It converts a 64-bit float to a float, which may turn
+// infinite according to the float policy.
+func D2F() Inst { return makeInst(opD2f) }
+
 func makeInst(op opCode) Inst {
 	return Inst(op) << 48
 }
 
 func (i Inst) withOpInt(arg int32) Inst {
-	return i | Inst(arg)
+	return i | Inst(uint32(arg))
 }
 
 func (i Inst) withOpFloat(arg float32) Inst {
@@ -183,6 +532,10 @@ func (i Inst) withOpInstPtr(to InstPtr) Inst {
 	return i | Inst(to)
 }
 
+func (i Inst) withOpB(arg uint16) Inst {
+	return i | Inst(arg)<<32
+}
+
 func (i Inst) opCode() opCode {
 	return opCode(i >> 48)
 }
@@ -195,6 +548,10 @@ func (i Inst) argFloat() float32 {
 	return math.Float32frombits(uint32(i & 0xFFFF_FFFF))
 }
 
+func (i Inst) argB() uint16 {
+	return uint16(i >> 32)
+}
+
 func (i Inst) execute(vm *VirtualMachine) error {
 	switch i.opCode() {
 	case opNop:
@@ -212,6 +569,36 @@ func (i Inst) execute(vm *VirtualMachine) error {
 	case opRet:
 		_, err := vm.stack.unwindFrame(int(i.argInt()))
 		return err
+	case opRetv:
+		frame := vm.stack.currentFrame()
+		n := len(vm.stack.data) - frame.stackBase - int(i.argInt())
+		if i.argInt() < 0 || n < 0 {
+			return ErrStackUnderflow
+		}
+		_, err := vm.stack.unwindFrame(n)
+		return err
+	case opCall:
+		return vm.call(int(i.argInt()), int(i.argB()))
+	case opThrow:
+		v, err := vm.stack.pop()
+		if err != nil {
+			return err
+		}
+		return &Exception{Value: v}
+	case opCoroutine:
+		fn, err := vm.stack.pop()
+		if err != nil {
+			return err
+		}
+		co, err := NewCoroutine(vm, fn)
+		if err != nil {
+			return err
+		}
+		return vm.stack.push(co)
+	case opResume:
+		return vm.resume(int(i.argInt()), int(i.argB()))
+	case opYield:
+		return vm.yield(int(i.argInt()), int(i.argB()))
 	case opDup:
 		v, err := vm.stack.peek(int(i.argInt()))
 		if err != nil {
@@ -228,49 +615,145 @@ func (i Inst) execute(vm *VirtualMachine) error {
 			return err
 		}
 		return vm.stack.poke(int(i.argInt()), v)
+	case opPushk:
+		k, err := vm.constant(int(i.argInt()))
+		if err != nil {
+			return err
+		}
+		return vm.stack.push(k)
+	case opLoad:
+		slot, err := vm.variable(int(i.argInt()))
+		if err != nil {
+			return err
+		}
+		v, err := vm.stack.peek(slot)
+		if err != nil {
+			return err
+		}
+		return vm.stack.push(v)
+	case opStore:
+		slot, err := vm.variable(int(i.argInt()))
+		if err != nil {
+			return err
+		}
+		v, err := vm.stack.pop()
+		if err != nil {
+			return err
+		}
+		return vm.stack.poke(slot, v)
+	case opVararg:
+		return withIntSingle(vm, func(idx int32) error {
+			v, err := vm.vararg(idx)
+			if err != nil {
+				return err
+			}
+			return vm.stack.push(v)
+		})
+	case opVarargn:
+		return vm.stack.push(NewInt(int32(len(vm.stack.currentFrame().varargs))))
 	case opAddi:
 		return withIntTuple(vm, func(a, b int32) error {
-			return vm.stack.push(NewInt(a + b))
+			return vm.pushInt(int64(a) + int64(b))
 		})
 	case opAddf:
 		return withFloatTuple(vm, func(a, b float32) error {
-			return vm.stack.push(NewFloat(a + b))
+			return vm.pushFloat(a + b)
 		})
 	case opSubi:
 		return withIntTuple(vm, func(a, b int32) error {
-			return vm.stack.push(NewInt(a - b))
+			return vm.pushInt(int64(a) - int64(b))
 		})
 	case opSubf:
 		return withFloatTuple(vm, func(a, b float32) error {
-			return vm.stack.push(NewFloat(a - b))
+			return vm.pushFloat(a - b)
 		})
 	case opMuli:
 		return withIntTuple(vm, func(a, b int32) error {
-			return vm.stack.push(NewInt(a * b))
+			return vm.pushInt(int64(a) * int64(b))
 		})
 	case opMulf:
 		return withFloatTuple(vm, func(a, b float32) error {
-			return vm.stack.push(NewFloat(a * b))
+			return vm.pushFloat(a * b)
 		})
 	case opDivi:
 		return withIntTuple(vm, func(a, b int32) error {
-			return vm.stack.push(NewInt(a / b))
+			return vm.divide(a, b, false)
 		})
 	case opDivf:
 		return withFloatTuple(vm, func(a, b float32) error {
-			return vm.stack.push(NewFloat(a / b))
+			return vm.pushFloat(a / b)
 		})
 	case opModi:
 		return withIntTuple(vm, func(a, b int32) error {
-			return vm.stack.push(NewInt(a % b))
+			return vm.divide(a, b, true)
 		})
 	case opNegi:
 		return withIntSingle(vm, func(a int32) error {
-			return vm.stack.push(NewInt(-a))
+			return vm.pushInt(-int64(a))
 		})
 	case opNegf:
 		return withFloatSingle(vm, func(a float32) error {
-			return vm.stack.push(NewFloat(-a))
+			return vm.pushFloat(-a)
+		})
+	case opAddic:
+		return withIntTuple(vm, func(a, b int32) error {
+			return vm.pushIntMode(int64(a)+int64(b), IntegerTrap)
+		})
+	case opSubic:
+		return withIntTuple(vm, func(a, b int32) error {
+			return vm.pushIntMode(int64(a)-int64(b), IntegerTrap)
+		})
+	case opMulic:
+		return withIntTuple(vm, func(a, b int32) error {
+			return vm.pushIntMode(int64(a)*int64(b), IntegerTrap)
+		})
+	case opNegic:
+		return withIntSingle(vm, func(a int32) error {
+			return vm.pushIntMode(-int64(a), IntegerTrap)
+		})
+	case opAddl:
+		return withInt64Tuple(vm, func(a, b int64) error {
+			return vm.pushInt64(add64(a, b))
+		})
+	case opAddd:
+		return withFloat64Tuple(vm, func(a, b float64) error {
+			return vm.pushFloat64(a + b)
+		})
+	case opSubl:
+		return withInt64Tuple(vm, func(a, b int64) error {
+			return vm.pushInt64(sub64(a, b))
+		})
+	case opSubd:
+		return withFloat64Tuple(vm, func(a, b float64) error {
+			return vm.pushFloat64(a - b)
+		})
+	case opMull:
+		return withInt64Tuple(vm, func(a, b int64) error {
+			return vm.pushInt64(mul64(a, b))
+		})
+	case opMuld:
+		return withFloat64Tuple(vm, func(a, b float64) error {
+			return vm.pushFloat64(a * b)
+		})
+	case opDivl:
+		return withInt64Tuple(vm, func(a, b int64) error {
+			return vm.divide64(a, b, false)
+		})
+	case opDivd:
+		return withFloat64Tuple(vm, func(a, b float64) error {
+			return vm.pushFloat64(a / b)
+		})
+	case opModl:
+		return withInt64Tuple(vm, func(a, b int64) error {
+			return vm.divide64(a, b, true)
+		})
+	case opNegl:
+		return withInt64Single(vm, func(a int64) error {
+			return vm.pushInt64(-a, a == math.MinInt64, true)
+		})
+	case opNegd:
+		return withFloat64Single(vm, func(a float64) error {
+			return vm.pushFloat64(-a)
 		})
 	case opEqi:
 		return withIntTuple(vm, func(a, b int32) error {
@@ -336,8 +819,111 @@ func (i Inst) execute(vm *VirtualMachine) error {
 		return withFloatTuple(vm, func(a, b float32) error {
 			return vm.stack.push(NewBool(a <= b))
 		})
+	case opEql:
+		return withInt64Tuple(vm, func(a, b int64) error {
+			return vm.stack.push(NewBool(a == b))
+		})
+	case opEqd:
+		return withFloat64Tuple(vm, func(a, b float64) error {
+			return vm.stack.push(NewBool(a == b))
+		})
+	case opNel:
+		return withInt64Tuple(vm, func(a, b int64) error {
+			return vm.stack.push(NewBool(a != b))
+		})
+	case opNed:
+		return withFloat64Tuple(vm, func(a, b float64) error {
+			return vm.stack.push(NewBool(a != b))
+		})
+	case opGtl:
+		return withInt64Tuple(vm, func(a, b int64) error {
+			return vm.stack.push(NewBool(a > b))
+		})
+	case opGtd:
+		return withFloat64Tuple(vm, func(a, b float64) error {
+			return vm.stack.push(NewBool(a > b))
+		})
+	case opGel:
+		return withInt64Tuple(vm, func(a, b int64) error {
+			return vm.stack.push(NewBool(a >= b))
+		})
+	case opGed:
+		return withFloat64Tuple(vm, func(a, b float64) error {
+			return vm.stack.push(NewBool(a >= b))
+		})
+	case opLtl:
+		return withInt64Tuple(vm, func(a, b int64) error {
+			return vm.stack.push(NewBool(a < b))
+		})
+	case opLtd:
+		return withFloat64Tuple(vm, func(a, b float64) error {
+			return vm.stack.push(NewBool(a < b))
+		})
+	case opLel:
+		return withInt64Tuple(vm, func(a, b int64) error {
+			return vm.stack.push(NewBool(a <= b))
+		})
+	case opLed:
+		return withFloat64Tuple(vm, func(a, b float64) error {
+			return vm.stack.push(NewBool(a <= b))
+		})
+	case opClosure:
+		return vm.closure(int(i.argInt()))
+	case opGetUpval:
+		uv, err := vm.upvalue(int(i.argInt()))
+		if err != nil {
+			return err
+		}
+		return vm.stack.push(uv.get())
+	case opSetUpval:
+		uv, err := vm.upvalue(int(i.argInt()))
+		if err != nil {
+			return err
+		}
+		v, err := vm.stack.pop()
+		if err != nil {
+			return err
+		}
+		uv.set(v)
+		return nil
+	case opGetGlobal:
+		name, err := vm.globalName(int(i.argInt()))
+		if err != nil {
+			return err
+		}
+		v, err := vm.getGlobal(name)
+		if err != nil {
+			return err
+		}
+		return vm.stack.push(v)
+	case opSetGlobal:
+		name, err := vm.globalName(int(i.argInt()))
+		if err != nil {
+			return err
+		}
+		v, err := vm.stack.pop()
+		if err != nil {
+			return err
+		}
+		return vm.setGlobal(name, v)
+	case opI2l:
+		return withIntSingle(vm, func(a int32) error {
+			return vm.stack.push(NewInt64(int64(a)))
+		})
+	case opL2i:
+		return withInt64Single(vm, func(a int64) error {
+			return vm.pushInt(a)
+		})
+	case opF2d:
+		return withFloatSingle(vm, func(a float32) error {
+			return vm.stack.push(NewFloat64(float64(a)))
+		})
+	case opD2f:
+		return withFloat64Single(vm, func(a float64) error {
+			return vm.pushFloat(float32(a))
+		})
 	default:
-		panic("not implemented")
+		return fmt.Errorf("%w: unknown opcode %#04x", ErrInvalidProgram, uint16(i.opCode()))
 	}
 }
 
@@ -365,6 +951,22 @@ func withFloatSingle(vm *VirtualMachine, f func(a float32) error) error {
 	return f(a)
 }
 
+func withInt64Single(vm *VirtualMachine, f func(a int64) error) error {
+	a, err := vm.stack.popInt64()
+	if err != nil {
+		return err
+	}
+	return f(a)
+}
+
+func withFloat64Single(vm *VirtualMachine, f func(a float64) error) error {
+	a, err := vm.stack.popFloat64()
+	if err != nil {
+		return err
+	}
+	return f(a)
+}
+
 func withIntTuple(vm *VirtualMachine, f func(a, b int32) error) error {
 	b, err := vm.stack.popInt()
 	if err != nil {
@@ -389,6 +991,30 @@ func withFloatTuple(vm *VirtualMachine, f func(a, b float32) error) error {
 	return f(a, b)
 }
 
+func withInt64Tuple(vm *VirtualMachine, f func(a, b int64) error) error {
+	b, err := vm.stack.popInt64()
+	if err != nil {
+		return err
+	}
+	a, err := vm.stack.popInt64()
+	if err != nil {
+		return err
+	}
+	return f(a, b)
+}
+
+func withFloat64Tuple(vm *VirtualMachine, f func(a, b float64) error) error {
+	b, err := vm.stack.popFloat64()
+	if err != nil {
+		return err
+	}
+	a, err := vm.stack.popFloat64()
+	if err != nil {
+		return err
+	}
+	return f(a, b)
+}
+
 func withBoolTuple(vm *VirtualMachine, f func(a, b bool) error) error {
 	b, err := vm.stack.popBool()
 	if err != nil {
@@ -0,0 +1,178 @@
+package stackvm
+
+import (
+	"context"
+	"fmt"
+)
+
+// CoroutineStatus is the status of a coroutine.
+type CoroutineStatus uint8
+
+const (
+	// CoroutineSuspended is the status of a coroutine that is not started yet or that
+	// yielded, and can be resumed.
+	CoroutineSuspended CoroutineStatus = iota
+
+	// CoroutineRunning is the status of a coroutine that is being executed, or that
+	// resumed another coroutine.
+	CoroutineRunning
+
+	// CoroutineDead is the status of a coroutine that returned or raised an uncaught
+	// exception, and cannot be resumed anymore.
+	CoroutineDead
+)
+
+var coroutineStatusNames = map[CoroutineStatus]string{
+	CoroutineSuspended: "suspended",
+	CoroutineRunning:   "running",
+	CoroutineDead:      "dead",
+}
+
+func (s CoroutineStatus) String() string {
+	return coroutineStatusNames[s]
+}
+
+// Coroutine is a function executed on its own stack, that can suspend its execution by
+// yielding values and be resumed later on.
+type Coroutine struct {
+	vm      *VirtualMachine
+	fn      *Function
+	stack   *stack
+	status  CoroutineStatus
+	started bool
+
+	caller   *stack     // the stack that resumed the coroutine, nil if resumed from the host
+	callerCo *Coroutine // the coroutine that resumed the coroutine, if any
+	nres     int        // the number of values expected by the caller
+	yieldRes int        // the number of values expected by the coroutine when resumed
+}
+
+// Status returns the status of the coroutine.
+func (c *Coroutine) Status() CoroutineStatus {
+	return c.status
+}
+
+// Resume resumes the coroutine from the host. The arguments are passed to the function of
+// the coroutine the first time it is resumed, and returned by the YIELD instruction that
+// suspended it otherwise. It returns the values yielded or returned by the coroutine.
+func (c *Coroutine) Resume(args ...Value) ([]Value, error) {
+	return c.ResumeContext(context.Background(), args...)
+}
+
+// ResumeContext resumes the coroutine from the host like Resume, until it yields, returns
+// or the context is done.
+func (c *Coroutine) ResumeContext(ctx context.Context, args ...Value) ([]Value, error) {
+	vm := c.vm
+	stack, co := vm.stack, vm.co
+	defer func() {
+		vm.stack, vm.co = stack, co
+	}()
+	if co == nil && stack.currentFrame() == nil {
+		vm.used = 0 // the VM is not running, so this is a new run
+	}
+	if err := vm.enterCoroutine(c, args, anyResults, nil, nil); err != nil {
+		return nil, err
+	}
+	vm.nested++
+	defer func() { vm.nested-- }()
+	return vm.exec(ctx)
+}
+
+func (vm *VirtualMachine) newCoroutine(fn Value) (*Coroutine, error) {
+	f, err := fn.AsFunction()
+	if err != nil {
+		return nil, err
+	}
+	return &Coroutine{vm: vm, fn: f, stack: vm.newStack()}, nil
+}
+
+// resume resumes the coroutine on top of the stack, with nargs arguments below it.
+func (vm *VirtualMachine) resume(nargs, nres int) error {
+	v, err := vm.stack.pop()
+	if err != nil {
+		return err
+	}
+	co, err := v.AsCoroutine()
+	if err != nil {
+		return err
+	}
+	if co.vm != vm {
+		return fmt.Errorf("%w: coroutine belongs to another VM", ErrIllegalState)
+	}
+	args, err := vm.stack.popN(nargs)
+	if err != nil {
+		return err
+	}
+	return vm.enterCoroutine(co, args, nres, vm.stack, vm.co)
+}
+
+// enterCoroutine switches the execution to the given coroutine.
+func (vm *VirtualMachine) enterCoroutine(co *Coroutine, args []Value, nres int, caller *stack, callerCo *Coroutine) error {
+	if co.status != CoroutineSuspended {
+		return fmt.Errorf("%w: cannot resume %s coroutine", ErrIllegalState, co.status)
+	}
+	if co.started && len(args) != co.yieldRes {
+		return fmt.Errorf("%w: expected %d arguments, got %d", ErrArityMismatch, co.yieldRes, len(args))
+	}
+	if vm.verify {
+		if err := Verify(co.fn.proto); err != nil {
+			return err
+		}
+	}
+	for _, arg := range args {
+		if err := co.stack.push(arg); err != nil {
+			return err
+		}
+	}
+	if !co.started {
+		frame, err := co.stack.newFrame(co.fn.proto, len(args))
+		if err != nil {
+			co.stack.popAll()
+			return err
+		}
+		frame.upvals = co.fn.upvals
+		co.started = true
+	}
+	// The coroutine returns to the caller from its bottom frame.
+	co.stack.frames[0].nres = nres
+	co.status = CoroutineRunning
+	co.caller, co.callerCo, co.nres = caller, callerCo, nres
+	vm.stack, vm.co = co.stack, co
+	return nil
+}
+
+// yield suspends the current coroutine, passing n values to its caller, and expecting
+// nres values when resumed.
+func (vm *VirtualMachine) yield(n, nres int) error {
+	co := vm.co
+	if co == nil {
+		return fmt.Errorf("%w: yield outside of coroutine", ErrIllegalState)
+	}
+	if co.nres != anyResults && n != co.nres {
+		return fmt.Errorf("%w: expected %d results, got %d", ErrArityMismatch, co.nres, n)
+	}
+	values, err := vm.stack.popN(n)
+	if err != nil {
+		return err
+	}
+	co.status = CoroutineSuspended
+	co.yieldRes = nres
+	return vm.leaveCoroutine(values)
+}
+
+// leaveCoroutine switches the execution from the current coroutine back to its caller,
+// passing the given values.
+func (vm *VirtualMachine) leaveCoroutine(values []Value) error {
+	co := vm.co
+	if co.caller == nil {
+		vm.yielded = &values
+		return nil
+	}
+	vm.stack, vm.co = co.caller, co.callerCo
+	for _, v := range values {
+		if err := vm.stack.push(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
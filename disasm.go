@@ -0,0 +1,248 @@
+package stackvm
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// String returns the instruction in assembly language. Constant operands are printed as
+// pool indices prefixed by '#', since the instruction alone does not know its pool.
+func (i Inst) String() string {
+	info, ok := opInfos[i.opCode()]
+	if !ok {
+		return fmt.Sprintf("INVALID 0x%016X", uint64(i))
+	}
+	switch info.operand {
+	case operandInt:
+		return fmt.Sprintf("%s %d", info.mnemonic, i.argInt())
+	case operandFloat:
+		return fmt.Sprintf("%s %s", info.mnemonic, formatFloat(i.argFloat()))
+	case operandInstPtr:
+		return fmt.Sprintf("%s %d", info.mnemonic, uint32(i.argInt()))
+	case operandConst:
+		return fmt.Sprintf("%s #%d", info.mnemonic, i.argInt())
+	case operandCall:
+		return fmt.Sprintf("%s %d, %d", info.mnemonic, uint16(i.argInt()), i.argB())
+	default:
+		return info.mnemonic
+	}
+}
+
+// Disassemble writes the function prototype in assembly language, so it can be assembled
+// back with Assemble. The nested prototypes of its constant pool are written first as
+// separate functions, named after their debug info if available. The constant pool of
+// every function is written in order, jump targets are written as labels and every
+// instruction is annotated with its address. Host function constants cannot be written,
+// so prototypes referring to them fail with ErrInvalidProgram.
+func Disassemble(proto *FuncProto, w io.Writer) error {
+	if err := checkDisassemble(proto, make(map[*FuncProto]bool)); err != nil {
+		return err
+	}
+	d := &disassembler{w: w, names: make(map[*FuncProto]string), used: make(map[string]bool)}
+	d.name(proto, "main")
+	d.function(proto)
+	return d.err
+}
+
+// checkDisassemble checks that the constants of the prototype and its nested prototypes
+// can be written in assembly language.
+func checkDisassemble(proto *FuncProto, seen map[*FuncProto]bool) error {
+	seen[proto] = true
+	for _, k := range proto.constPool {
+		switch k.t {
+		case TypeHostFunction:
+			return fmt.Errorf("%w: cannot disassemble host function constant %s", ErrInvalidProgram, k.v.(*HostFunction).name)
+		case TypeFunction:
+			if fn := k.v.(*Function); !seen[fn.proto] {
+				if err := checkDisassemble(fn.proto, seen); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+type disassembler struct {
+	w     io.Writer
+	names map[*FuncProto]string
+	used  map[string]bool
+	err   error
+}
+
+// name assigns a unique function name to the prototype, taken from its debug info if
+// available or from the given fallback otherwise.
+func (d *disassembler) name(proto *FuncProto, fallback string) {
+	name := proto.name
+	if !isAsmName(name) || d.used[name] {
+		name = fallback
+	}
+	for i := 1; d.used[name]; i++ {
+		name = fmt.Sprintf("%s_%d", fallback, i)
+	}
+	d.names[proto] = name
+	d.used[name] = true
+}
+
+func (d *disassembler) printf(format string, args ...any) {
+	if d.err == nil {
+		_, d.err = fmt.Fprintf(d.w, format, args...)
+	}
+}
+
+func (d *disassembler) function(proto *FuncProto) {
+	for _, k := range proto.constPool {
+		if fn, ok := k.v.(*Function); ok {
+			if _, done := d.names[fn.proto]; !done {
+				d.name(fn.proto, fmt.Sprintf("f%d", len(d.names)))
+				d.function(fn.proto)
+			}
+		}
+	}
+
+	labels := make(map[InstPtr]string)
+	for _, inst := range proto.bytecode {
+		if info, ok := opInfos[inst.opCode()]; ok && info.operand == operandInstPtr {
+			to := InstPtr(inst.argInt())
+			if to <= InstPtr(len(proto.bytecode)) {
+				labels[to] = fmt.Sprintf("L%04d", to)
+			}
+		}
+	}
+
+	for _, h := range proto.handlers {
+		for _, addr := range []InstPtr{h.start, h.end, h.target} {
+			if addr <= InstPtr(len(proto.bytecode)) {
+				labels[addr] = fmt.Sprintf("L%04d", addr)
+			}
+		}
+	}
+
+	d.printf(".func %s %d\n", d.names[proto], proto.nargs)
+	if d.names[proto] != proto.name {
+		d.printf(".name %s\n", strconv.Quote(proto.name))
+	}
+	if proto.variadic {
+		d.printf(".variadic\n")
+	}
+	if proto.nlocals > 0 {
+		d.printf(".locals %d\n", proto.nlocals)
+	}
+	if proto.paramTypes != nil {
+		d.printf(".paramtypes %s\n", asmTypeNames(proto.paramTypes))
+	}
+	if proto.resultTypes != nil {
+		d.printf(".resulttypes %s\n", asmTypeNames(proto.resultTypes))
+	} else if proto.hasResults {
+		d.printf(".results %d\n", proto.nresults)
+	}
+	for _, uv := range proto.upvals {
+		if uv.local {
+			d.printf(".upval local %d\n", uv.index)
+		} else {
+			d.printf(".upval upval %d\n", uv.index)
+		}
+	}
+	for _, h := range proto.handlers {
+		d.printf(".handler %s %s %s\n", d.label(labels, h.start), d.label(labels, h.end), d.label(labels, h.target))
+	}
+	// Literals are written as operands only if assembling them finds the same constant.
+	operands := make([]string, len(proto.constPool))
+	seen := make(map[any]bool)
+	for k, v := range proto.constPool {
+		d.printf(".const %s\n", d.constant(v))
+		operands[k] = "#" + strconv.Itoa(k)
+		if key, ok := constKey(v); ok && v.t != TypeError && !seen[key] {
+			operands[k] = d.constant(v)
+			seen[key] = true
+		}
+	}
+	for addr, inst := range proto.bytecode {
+		if label, ok := labels[InstPtr(addr)]; ok {
+			d.printf("%s:\n", label)
+		}
+		d.printf("\t%-24s ; %04d\n", d.inst(inst, labels, operands), addr)
+	}
+	if label, ok := labels[InstPtr(len(proto.bytecode))]; ok {
+		d.printf("%s:\n", label)
+	}
+	d.printf(".end\n\n")
+}
+
+func (d *disassembler) label(labels map[InstPtr]string, addr InstPtr) string {
+	if label, ok := labels[addr]; ok {
+		return label
+	}
+	return strconv.Itoa(int(addr))
+}
+
+func (d *disassembler) inst(inst Inst, labels map[InstPtr]string, consts []string) string {
+	info, ok := opInfos[inst.opCode()]
+	if !ok {
+		return inst.String()
+	}
+	switch info.operand {
+	case operandInstPtr:
+		if label, ok := labels[InstPtr(inst.argInt())]; ok {
+			return info.mnemonic + " " + label
+		}
+	case operandConst:
+		if k := int(inst.argInt()); k >= 0 && k < len(consts) {
+			return info.mnemonic + " " + consts[k]
+		}
+	}
+	return inst.String()
+}
+
+func (d *disassembler) constant(v Value) string {
+	switch v.t {
+	case TypeInt:
+		return strconv.Itoa(int(v.v.(int32)))
+	case TypeFloat:
+		return formatFloat(v.v.(float32))
+	case TypeInt64:
+		return strconv.FormatInt(v.v.(int64), 10) + "L"
+	case TypeFloat64:
+		return formatFloatBits(v.v.(float64), 64) + "D"
+	case TypeBool:
+		return strconv.FormatBool(v.v.(bool))
+	case TypeString:
+		return strconv.Quote(v.v.(string))
+	case TypeFunction:
+		return d.names[v.v.(*Function).proto]
+	case TypeError:
+		return "error " + strconv.Quote(v.v.(error).Error())
+	default:
+		return "none"
+	}
+}
+
+// formatFloat formats a float so that it is never mistaken for an integer.
+func formatFloat(f float32) string {
+	return formatFloatBits(float64(f), 32)
+}
+
+// formatFloatBits formats a float of the given bit size like formatFloat.
+func formatFloatBits(f float64, bitSize int) string {
+	s := strconv.FormatFloat(f, 'g', -1, bitSize)
+	if math.IsInf(f, 0) || math.IsNaN(f) || strings.ContainsAny(s, ".e") {
+		return s
+	}
+	return s + ".0"
+}
+
+// asmTypeName returns the name of a type in assembly language, which has no spaces.
+func asmTypeName(t typeTag) string {
+	return strings.ReplaceAll(typeNames[t], " ", "")
+}
+
+func asmTypeNames(types []typeTag) string {
+	names := make([]string, len(types))
+	for i, t := range types {
+		names[i] = asmTypeName(t)
+	}
+	return strings.Join(names, " ")
+}
@@ -0,0 +1,175 @@
+package stackvm_test
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/apoloval/stackvm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInst_String(t *testing.T) {
+	for _, test := range []struct {
+		inst     stackvm.Inst
+		expected string
+	}{
+		{stackvm.NOP(), "NOP"},
+		{stackvm.PUSHI(-42), "PUSHI -42"},
+		{stackvm.PUSHF(2), "PUSHF 2.0"},
+		{stackvm.PUSHF(0.5), "PUSHF 0.5"},
+		{stackvm.BR(12), "BR 12"},
+		{stackvm.PUSHK(3), "PUSHK #3"},
+		{stackvm.CALL(2, 1), "CALL 2, 1"},
+		{stackvm.Inst(0xFFFF << 48), "INVALID 0xFFFF000000000000"},
+	} {
+		assert.Equal(t, test.expected, test.inst.String())
+	}
+}
+
+func TestDisassemble(t *testing.T) {
+	src := `
+.func scale 1
+.locals 1
+.paramtypes float
+.resulttypes float
+.upval local 1
+	GETUPVAL 0
+	DUP 0
+	MULF
+	RET 1
+.end
+
+.func main 2
+.handler loop done fail
+	PUSHF 0.0
+	PUSHF 1.5
+	CLOSURE scale
+loop:
+	DUP 0
+	PUSHI 0
+	LEI
+	BR done
+	DUP 2
+	DUP 1
+	CALL 1, 1
+	PUSHF 2.0
+	ADDF
+	DUP 2
+	ADDF
+	POP 2
+	DUP 0
+	PUSHI 1
+	SUBI
+	POP 0
+	JMP loop
+done:
+	DUP 2
+	PUSHK "sum"
+	RET 2
+fail:
+	RET 1
+.end
+`
+	proto, err := stackvm.Assemble(strings.NewReader(src))
+	require.NoError(t, err)
+
+	var out bytes.Buffer
+	require.NoError(t, stackvm.Disassemble(proto, &out))
+	assert.Contains(t, out.String(), "L0003:\n")
+	assert.Contains(t, out.String(), ".handler L0003 L0020 L0023\n")
+	assert.Contains(t, out.String(), "\tJMP L0003                ; 0019\n")
+	assert.Contains(t, out.String(), "\tPUSHK \"sum\"              ; 0021\n")
+
+	assert.Contains(t, out.String(), ".func scale 1\n.locals 1\n.paramtypes float\n.resulttypes float\n")
+	assert.Contains(t, out.String(), "\tCLOSURE scale            ; 0002\n")
+
+	again, err := stackvm.Assemble(&out)
+	require.NoError(t, err)
+
+	expected, err := stackvm.WithoutPositions(proto).MarshalBinary()
+	require.NoError(t, err)
+	actual, err := stackvm.WithoutPositions(again).MarshalBinary()
+	require.NoError(t, err)
+	assert.Equal(t, expected, actual)
+}
+
+func TestDisassemble_WideConstants(t *testing.T) {
+	proto, err := stackvm.Assemble(strings.NewReader(`
+.func main 0
+	PUSHK 9000000000L
+	PUSHK 0.1D
+	PUSHK 2D
+	RET 3
+.end
+`))
+	require.NoError(t, err)
+
+	var out bytes.Buffer
+	require.NoError(t, stackvm.Disassemble(proto, &out))
+	assert.Contains(t, out.String(), "\tPUSHK 9000000000L        ; 0000\n")
+	assert.Contains(t, out.String(), "\tPUSHK 0.1D               ; 0001\n")
+	assert.Contains(t, out.String(), "\tPUSHK 2.0D               ; 0002\n")
+
+	again, err := stackvm.Assemble(bytes.NewReader(out.Bytes()))
+	require.NoError(t, err)
+	values, err := stackvm.New().Run(again)
+	require.NoError(t, err)
+	assert.Equal(t, []stackvm.Value{stackvm.NewInt64(9_000_000_000), stackvm.NewFloat64(0.1), stackvm.NewFloat64(2)}, values)
+}
+
+func TestDisassemble_ConstantPool(t *testing.T) {
+	proto, err := stackvm.NewFuncProto(0, func(b *stackvm.FuncProtoBuilder) {
+		b.SetName("odd \"name\": 1")
+		b.AddConst(stackvm.NewString("unused"))
+		b.Emit(stackvm.PUSHK(b.AddConst(stackvm.NewError(errors.New("boom")))))
+		b.Emit(stackvm.PUSHK(b.AddConst(stackvm.NewString("used"))))
+		b.Emit(stackvm.RET(2))
+	})
+	require.NoError(t, err)
+
+	var out bytes.Buffer
+	require.NoError(t, stackvm.Disassemble(proto, &out))
+	assert.Contains(t, out.String(), ".func main 0\n.name \"odd \\\"name\\\": 1\"\n")
+	assert.Contains(t, out.String(), ".const \"unused\"\n.const error \"boom\"\n.const \"used\"\n")
+	assert.Contains(t, out.String(), "\tPUSHK #1                 ; 0000\n")
+	assert.Contains(t, out.String(), "\tPUSHK \"used\"             ; 0001\n")
+
+	again, err := stackvm.Assemble(bytes.NewReader(out.Bytes()))
+	require.NoError(t, err)
+	assert.Equal(t, proto.Name(), again.Name())
+	var outAgain bytes.Buffer
+	require.NoError(t, stackvm.Disassemble(again, &outAgain))
+	assert.Equal(t, out.String(), outAgain.String())
+
+	values, err := stackvm.New().Run(again)
+	require.NoError(t, err)
+	require.Len(t, values, 2)
+	exc, err := values[0].AsError()
+	require.NoError(t, err)
+	assert.EqualError(t, exc, "boom")
+	assert.Equal(t, stackvm.NewString("used"), values[1])
+}
+
+func TestDisassemble_HostFunction(t *testing.T) {
+	host := stackvm.NewHostFunction("host", func(vm *stackvm.VirtualMachine, args []stackvm.Value) ([]stackvm.Value, error) {
+		return nil, nil
+	})
+	inner, err := stackvm.NewFuncProto(0, func(b *stackvm.FuncProtoBuilder) {
+		b.Emit(stackvm.PUSHK(b.AddConst(host)))
+		b.Emit(stackvm.RET(1))
+	})
+	require.NoError(t, err)
+	proto, err := stackvm.NewFuncProto(0, func(b *stackvm.FuncProtoBuilder) {
+		b.Emit(stackvm.PUSHK(b.AddProto(inner)))
+		b.Emit(stackvm.RET(1))
+	})
+	require.NoError(t, err)
+
+	var out bytes.Buffer
+	err = stackvm.Disassemble(proto, &out)
+	assert.ErrorIs(t, err, stackvm.ErrInvalidProgram)
+	assert.Zero(t, out.Len())
+}
@@ -1,20 +1,127 @@
 package stackvm
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
 
 var (
+	// ErrArithmetic is returned when an arithmetic operation fails, like a division by
+	// zero or an overflow trapped by the integer mode.
+	ErrArithmetic = errors.New("arithmetic error")
+
+	// ErrArityMismatch is returned when the number of arguments or results is not expected.
+	ErrArityMismatch = errors.New("arity mismatch")
+
+	// ErrBudgetExceeded is returned when a run exceeds its instruction budget.
+	ErrBudgetExceeded = errors.New("budget exceeded")
+
 	// ErrIllegalState is returned when the requested action is not allowed in the current state.
 	ErrIllegalState = errors.New("illegal state")
 
+	// ErrInternal is returned when the virtual machine or the function builder faults
+	// internally, instead of panicking.
+	ErrInternal = errors.New("internal error")
+
+	// ErrInterrupted is returned when a run is interrupted by its context.
+	ErrInterrupted = errors.New("interrupted")
+
 	// ErrInvalidProgram is returned when the program is invalid.
 	ErrInvalidProgram = errors.New("invalid program")
 
+	// ErrInvalidSnapshot is returned when a snapshot is corrupted or does not match the
+	// program it is restored against.
+	ErrInvalidSnapshot = errors.New("invalid snapshot")
+
+	// ErrReadOnlyGlobal is returned when the bytecode sets a global variable marked as
+	// read-only by the host.
+	ErrReadOnlyGlobal = errors.New("read-only global")
+
 	// ErrStackOverflow is returned when the stack is full.
 	ErrStackOverflow = errors.New("stack overflow")
 
 	// ErrStackUnderflow is returned when the stack is empty.
 	ErrStackUnderflow = errors.New("stack underflow")
 
+	// ErrSuspended is returned when a run is suspended by a host function. The run can be
+	// continued once the results of the host function are given to Resume.
+	ErrSuspended = errors.New("suspended")
+
 	// ErrTypeMismatch is returned when the type of the value is not expected.
 	ErrTypeMismatch = errors.New("type mismatch")
+
+	// ErrUndefinedGlobal is returned when the bytecode gets a global variable that is not
+	// defined.
+	ErrUndefinedGlobal = errors.New("undefined global")
 )
+
+// Exception is the error raised by a THROW instruction. It carries the thrown value.
+type Exception struct {
+	Value Value
+}
+
+func (e *Exception) Error() string {
+	if err, ok := e.Value.v.(error); ok && e.Value.t == TypeError {
+		return err.Error()
+	}
+	return fmt.Sprintf("uncaught exception: %s", e.Value)
+}
+
+// Unwrap returns the error carried by a thrown error value, so rethrown runtime faults can
+// still be checked with errors.Is and errors.As.
+func (e *Exception) Unwrap() error {
+	if err, ok := e.Value.v.(error); ok && e.Value.t == TypeError {
+		return err
+	}
+	return nil
+}
+
+// RuntimeError is returned when the execution of an instruction fails. It wraps the error
+// that caused the failure, so it can still be checked with errors.Is and errors.As.
+type RuntimeError struct {
+	Err   error        // the cause of the failure
+	Inst  Inst         // the failing instruction
+	IP    InstPtr      // the address of the failing instruction
+	Trace []TraceEntry // the active function calls, innermost first
+}
+
+func (e *RuntimeError) Error() string {
+	if len(e.Trace) == 0 {
+		return fmt.Sprintf("%v [%s at %04d]", e.Err, e.Inst, e.IP)
+	}
+	return fmt.Sprintf("%v [%s at %s]", e.Err, e.Inst, e.Trace[0])
+}
+
+// Unwrap returns the cause of the failure.
+func (e *RuntimeError) Unwrap() error {
+	return e.Err
+}
+
+// Traceback returns a human-readable description of the active function calls, one per
+// line, innermost first.
+func (e *RuntimeError) Traceback() string {
+	var sb strings.Builder
+	for _, entry := range e.Trace {
+		fmt.Fprintf(&sb, "\tat %s\n", entry)
+	}
+	return sb.String()
+}
+
+// TraceEntry describes an active function call in the traceback of a runtime error.
+type TraceEntry struct {
+	Function string   // the name of the function, if known
+	IP       InstPtr  // the address of the instruction being executed
+	Pos      Position // the source position of the instruction, if known
+}
+
+func (e TraceEntry) String() string {
+	name := e.Function
+	if name == "" {
+		name = "?"
+	}
+	if e.Pos == (Position{}) {
+		return fmt.Sprintf("%s+%04d", name, e.IP)
+	}
+	return fmt.Sprintf("%s+%04d (%s)", name, e.IP, e.Pos)
+}
@@ -0,0 +1,16 @@
+package stackvm
+
+// WithoutPositions returns a copy of the prototype and its nested prototypes without
+// source positions, which differ between a source and its disassembly.
+func WithoutPositions(proto *FuncProto) *FuncProto {
+	p := *proto
+	p.positions = nil
+	p.constPool = make([]Value, len(proto.constPool))
+	for i, k := range proto.constPool {
+		if fn, ok := k.v.(*Function); ok {
+			k = newValue(TypeFunction, &Function{proto: WithoutPositions(fn.proto)})
+		}
+		p.constPool[i] = k
+	}
+	return &p
+}
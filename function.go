@@ -1,17 +1,63 @@
 package stackvm
 
-import "fmt"
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"slices"
+)
 
 // Function is a function that can be executed by the virtual machine.
 type Function struct {
-	proto *FuncProto
+	proto  *FuncProto
+	upvals []*upvalue
+}
+
+// HostFunc is a Go function that can be called from the virtual machine. It receives the
+// call arguments in push order and returns the call results in the same order.
+type HostFunc func(vm *VirtualMachine, args []Value) ([]Value, error)
+
+// HostFunction is a Go function registered to be called by the virtual machine.
+type HostFunction struct {
+	name string
+	fn   HostFunc
+}
+
+// Name returns the name of the host function.
+func (f *HostFunction) Name() string {
+	return f.name
 }
 
 // FuncProto is a function prototype.
 type FuncProto struct {
-	nargs     int
-	bytecode  []Inst
-	constPool map[string]Inst
+	nargs       int
+	nlocals     int
+	nresults    int       // declared result count, if hasResults
+	hasResults  bool      // whether the result count is declared
+	variadic    bool      // whether extra arguments are accepted beyond nargs
+	paramTypes  []typeTag // declared types of the fixed arguments, if any
+	resultTypes []typeTag // declared types of the results, if any
+	bytecode    []Inst
+	constPool   []Value
+	upvals      []upvalDesc
+	handlers    []handler
+	maxStack    int  // maximum stack depth, zero if unknown
+	verified    bool // whether the prototype passed Verify
+
+	// debug info
+	name      string
+	positions []Position // source position of each instruction, if known
+}
+
+// Position is a position in the source code a function prototype was compiled from.
+// Lines and columns start at 1, and the zero value means unknown position.
+type Position struct {
+	Line   int
+	Column int
+}
+
+func (p Position) String() string {
+	return fmt.Sprintf("%d:%d", p.Line, p.Column)
 }
 
 // FuncProtoLabel is a label in a function prototype.
@@ -19,14 +65,33 @@ type FuncProtoLabel int
 
 // FuncProtoBuilder is a builder for function prototypes.
 type FuncProtoBuilder struct {
-	nargs     int
-	bytecode  []Inst
-	constPool map[string]Inst
-	fixups    []fixup
+	nargs       int
+	nlocals     int
+	nresults    int
+	hasResults  bool
+	variadic    bool
+	paramTypes  []typeTag
+	resultTypes []typeTag
+	scopes      []map[string]int // named locals of the enclosing lexical scopes, innermost last
+	bytecode    []Inst
+	constPool   []Value
+	constIdx    map[any]int
+	upvals      []upvalDesc
+	handlers    []handlerLabels
+	fixups      []fixup
+	name        string
+	pos         Position
+	positions   []Position
+	err         error // the first misuse of the builder, reported when built
 }
 
-// NewFuncProto creates a new function prototype.
+// NewFuncProto creates a new function prototype. Misusing the builder, like referring to
+// a label that was not created by it, fails with ErrInvalidProgram, and a fault of the
+// builder itself fails with ErrInternal. Panics of the given function are not recovered.
 func NewFuncProto(nargs int, f func(*FuncProtoBuilder)) (*FuncProto, error) {
+	if nargs < 0 {
+		return nil, fmt.Errorf("%w: negative argument count %d", ErrInvalidProgram, nargs)
+	}
 	builder := &FuncProtoBuilder{
 		nargs: nargs,
 	}
@@ -34,6 +99,77 @@ func NewFuncProto(nargs int, f func(*FuncProtoBuilder)) (*FuncProto, error) {
 	return builder.build()
 }
 
+// SetResults declares the number of results of the function. Returning a different number
+// of values fails, and so does calling it expecting a different number of results. Without
+// a declaration, the function may return any number of values.
+func (b *FuncProtoBuilder) SetResults(n int) {
+	b.nresults = n
+	b.hasResults = true
+}
+
+// SetVariadic makes the function accept any number of arguments beyond its fixed ones.
+// The extra arguments are kept apart from the stack, and reached with VARARG and VARARGN.
+func (b *FuncProtoBuilder) SetVariadic() {
+	b.variadic = true
+}
+
+// SetParamTypes declares the types of the fixed arguments of the function, one per
+// argument. Calling it with arguments of other types fails with ErrTypeMismatch before
+// its first instruction is executed.
+func (b *FuncProtoBuilder) SetParamTypes(types ...typeTag) {
+	if len(types) != b.nargs {
+		b.fail(fmt.Errorf("%w: %d parameter types for %d arguments", ErrInvalidProgram, len(types), b.nargs))
+		return
+	}
+	b.paramTypes = slices.Clone(types)
+}
+
+// SetResultTypes declares the number and types of the results of the function, as if
+// declared by SetResults. Returning values of other types fails with ErrTypeMismatch.
+func (b *FuncProtoBuilder) SetResultTypes(types ...typeTag) {
+	b.SetResults(len(types))
+	b.resultTypes = slices.Clone(types)
+}
+
+// NewLocal allocates a new local variable slot and returns its index, to be used by LOAD
+// and STORE. Local slots follow the argument slots, and are set to none when the frame is
+// created. If the name is not empty, the local can be looked up by Local until the end of
+// the current scope, shadowing any local with the same name of the enclosing scopes.
+func (b *FuncProtoBuilder) NewLocal(name string) int {
+	slot := b.nargs + b.nlocals
+	b.nlocals++
+	if name != "" {
+		if len(b.scopes) == 0 {
+			b.BeginScope()
+		}
+		b.scopes[len(b.scopes)-1][name] = slot
+	}
+	return slot
+}
+
+// Local returns the slot of the named local variable visible from the current scope.
+func (b *FuncProtoBuilder) Local(name string) (int, bool) {
+	for i := len(b.scopes) - 1; i >= 0; i-- {
+		if slot, ok := b.scopes[i][name]; ok {
+			return slot, true
+		}
+	}
+	return 0, false
+}
+
+// BeginScope begins a lexical scope. The locals allocated until the matching EndScope are
+// not visible by name after it. Slots are never reused, so every local keeps its own slot.
+func (b *FuncProtoBuilder) BeginScope() {
+	b.scopes = append(b.scopes, make(map[string]int))
+}
+
+// EndScope ends the innermost lexical scope.
+func (b *FuncProtoBuilder) EndScope() {
+	if len(b.scopes) > 0 {
+		b.scopes = b.scopes[:len(b.scopes)-1]
+	}
+}
+
 // NewLabel creates a new label to be used for jump instructions.
 func (b *FuncProtoBuilder) NewLabel() FuncProtoLabel {
 	b.fixups = append(b.fixups, fixup{
@@ -53,26 +189,209 @@ func (b *FuncProtoBuilder) NewLabelFixed() FuncProtoLabel {
 // Mark marks a label in the bytecode.
 func (b *FuncProtoBuilder) Mark(label FuncProtoLabel) InstPtr {
 	instPtr := InstPtr(len(b.bytecode))
-	b.fixups[label].value = instPtr
+	if f := b.fixup(label); f != nil {
+		f.value = instPtr
+	}
 	return instPtr
 }
 
+// fixup returns the fixup of a label, or nil if the label was not created by the builder,
+// recording the misuse to be reported when built.
+func (b *FuncProtoBuilder) fixup(label FuncProtoLabel) *fixup {
+	if label < 0 || int(label) >= len(b.fixups) {
+		b.fail(fmt.Errorf("%w: unknown label %d", ErrInvalidProgram, label))
+		return nil
+	}
+	return &b.fixups[label]
+}
+
+// fail records a misuse of the builder, to be reported when built. Only the first one is
+// kept.
+func (b *FuncProtoBuilder) fail(err error) {
+	if b.err == nil {
+		b.err = err
+	}
+}
+
 // Emit emits an instruction to the bytecode.
 func (b *FuncProtoBuilder) Emit(inst Inst) InstPtr {
 	b.bytecode = append(b.bytecode, inst)
+	if b.positions != nil || b.pos != (Position{}) {
+		b.positions = append(b.positions, make([]Position, len(b.bytecode)-1-len(b.positions))...)
+		b.positions = append(b.positions, b.pos)
+	}
 	return InstPtr(len(b.bytecode) - 1)
 }
 
+// AddHandler registers an exception handler for the instructions from start (inclusive)
+// to end (exclusive). If any of them raises an exception, the stack is restored to the
+// lowest height reached by the region, the exception value is pushed and execution
+// continues at target.
+// When several handlers cover an instruction, the first one registered is chosen, so
+// inner handlers must be registered before outer ones.
+func (b *FuncProtoBuilder) AddHandler(start, end, target FuncProtoLabel) {
+	b.handlers = append(b.handlers, handlerLabels{start: start, end: end, target: target})
+}
+
+// EmitTry emits a try statement. The catch block runs with the exception value on top of
+// the stack if the body raises an exception. The finally block runs after the body and
+// the catch block, either when they complete or when they raise an exception, which is
+// raised again after the finally block. Blocks must leave the stack as they found it,
+// except for the catch block, which must consume the exception value. Both catch and
+// finally are optional. The body and the catch block cannot return if there is a finally
+// block, since returning would skip it.
+func (b *FuncProtoBuilder) EmitTry(body, catch, finally func()) {
+	end := b.NewLabel()
+	start := b.NewLabelFixed()
+	bodyStart := len(b.bytecode)
+	body()
+	bodyEnd := b.NewLabelFixed()
+	b.checkTryReturns(bodyStart, finally)
+	if finally != nil {
+		finally()
+	}
+	b.EmitJump(end)
+
+	var catchStart, catchEnd FuncProtoLabel
+	if catch != nil {
+		catchStart = b.NewLabelFixed()
+		b.AddHandler(start, bodyEnd, catchStart)
+		blockStart := len(b.bytecode)
+		catch()
+		catchEnd = b.NewLabelFixed()
+		b.checkTryReturns(blockStart, finally)
+		if finally != nil {
+			finally()
+		}
+		b.EmitJump(end)
+	}
+
+	if finally != nil {
+		target := b.NewLabel()
+		b.AddHandler(start, bodyEnd, target)
+		if catch != nil {
+			b.AddHandler(catchStart, catchEnd, target)
+		}
+		b.Mark(target)
+		finally()
+		b.Emit(THROW())
+	}
+	b.Mark(end)
+}
+
+// checkTryReturns fails if a block of a try statement with a finally block, emitted from
+// the given address, returns.
+func (b *FuncProtoBuilder) checkTryReturns(from int, finally func()) {
+	if finally == nil {
+		return
+	}
+	for _, inst := range b.bytecode[from:] {
+		if op := inst.opCode(); op == opRet || op == opRetv {
+			b.fail(fmt.Errorf("%w: return from a try statement with a finally block", ErrInvalidProgram))
+			return
+		}
+	}
+}
+
+// SetName sets the name of the function, used in error tracebacks as debug info.
+func (b *FuncProtoBuilder) SetName(name string) {
+	b.name = name
+}
+
+// SetPosition sets the source position of the instructions emitted from now on, used in
+// error tracebacks as debug info.
+func (b *FuncProtoBuilder) SetPosition(pos Position) {
+	b.pos = pos
+}
+
 // EmitBranch emits a branch instruction to the bytecode with a label.
 // This configures a fixup for the branch instruction to the given label.
 // The label must be marked before the function proto is built.
 func (b *FuncProtoBuilder) EmitBranch(to FuncProtoLabel) InstPtr {
 	instPtr := b.Emit(BR(0))
-	b.fixups[to].refs = append(b.fixups[to].refs, instPtr)
+	if f := b.fixup(to); f != nil {
+		f.refs = append(f.refs, instPtr)
+	}
+	return instPtr
+}
+
+// EmitJump emits a jump instruction to the bytecode with a label.
+// This configures a fixup for the jump instruction to the given label.
+// The label must be marked before the function proto is built.
+func (b *FuncProtoBuilder) EmitJump(to FuncProtoLabel) InstPtr {
+	instPtr := b.Emit(JMP(0))
+	if f := b.fixup(to); f != nil {
+		f.refs = append(f.refs, instPtr)
+	}
 	return instPtr
 }
 
-func (b *FuncProtoBuilder) build() (*FuncProto, error) {
+// AddConst adds a value to the constant pool and returns its index, to be used by PUSHK
+// instructions. Adding a value that is already in the pool returns its existing index.
+func (b *FuncProtoBuilder) AddConst(v Value) int {
+	if key, ok := constKey(v); ok {
+		if idx, ok := b.constIdx[key]; ok {
+			return idx
+		}
+	}
+	return b.appendConst(v)
+}
+
+// appendConst appends a value to the constant pool and returns its index, even if the
+// value is already in the pool. Adding the value later returns its first index.
+func (b *FuncProtoBuilder) appendConst(v Value) int {
+	b.constPool = append(b.constPool, v)
+	idx := len(b.constPool) - 1
+	if key, ok := constKey(v); ok {
+		if _, dup := b.constIdx[key]; !dup {
+			if b.constIdx == nil {
+				b.constIdx = make(map[any]int)
+			}
+			b.constIdx[key] = idx
+		}
+	}
+	return idx
+}
+
+// AddProto adds a nested function prototype to the constant pool and returns its index,
+// to be used by CLOSURE instructions.
+func (b *FuncProtoBuilder) AddProto(proto *FuncProto) int {
+	return b.AddConst(newValue(TypeFunction, &Function{proto: proto}))
+}
+
+// CaptureLocal declares an upvalue that captures the given stack slot of the enclosing
+// function when the closure is created. It returns the index of the upvalue.
+func (b *FuncProtoBuilder) CaptureLocal(slot int) int {
+	b.upvals = append(b.upvals, upvalDesc{local: true, index: slot})
+	return len(b.upvals) - 1
+}
+
+// CaptureUpvalue declares an upvalue that captures the given upvalue of the enclosing
+// function when the closure is created. It returns the index of the upvalue.
+func (b *FuncProtoBuilder) CaptureUpvalue(idx int) int {
+	b.upvals = append(b.upvals, upvalDesc{local: false, index: idx})
+	return len(b.upvals) - 1
+}
+
+// build builds the prototype, reporting the misuses of the builder. Any panic raised while
+// building is recovered and reported as ErrInternal.
+func (b *FuncProtoBuilder) build() (proto *FuncProto, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			proto, err = nil, fmt.Errorf("%w: %v", ErrInternal, r)
+		}
+	}()
+	for _, h := range b.handlers {
+		b.fixup(h.start)
+		b.fixup(h.end)
+		b.fixup(h.target)
+	}
+	if b.resultTypes != nil && len(b.resultTypes) != b.nresults {
+		b.fail(fmt.Errorf("%w: %d result types for %d results", ErrInvalidProgram, len(b.resultTypes), b.nresults))
+	}
+	if b.err != nil {
+		return nil, b.err
+	}
 	for _, fixup := range b.fixups {
 		if fixup.value == nullInstPtr {
 			return nil, fmt.Errorf("%w: label not marked", ErrInvalidProgram)
@@ -81,14 +400,139 @@ func (b *FuncProtoBuilder) build() (*FuncProto, error) {
 			b.bytecode[ref] = b.bytecode[ref].withOpInstPtr(fixup.value)
 		}
 	}
-	return &FuncProto{
-		nargs:     b.nargs,
-		bytecode:  b.bytecode,
-		constPool: b.constPool,
-	}, nil
+	if b.positions != nil {
+		b.positions = append(b.positions, make([]Position, len(b.bytecode)-len(b.positions))...)
+	}
+	proto = &FuncProto{
+		nargs:       b.nargs,
+		nlocals:     b.nlocals,
+		nresults:    b.nresults,
+		hasResults:  b.hasResults,
+		variadic:    b.variadic,
+		paramTypes:  b.paramTypes,
+		resultTypes: b.resultTypes,
+		bytecode:    b.bytecode,
+		constPool:   b.constPool,
+		upvals:      b.upvals,
+		name:        b.name,
+		positions:   b.positions,
+	}
+	for _, h := range b.handlers {
+		proto.handlers = append(proto.handlers, handler{
+			start:  b.fixups[h.start].value,
+			end:    b.fixups[h.end].value,
+			target: b.fixups[h.target].value,
+		})
+	}
+
+	// Handler heights and the maximum stack depth are taken from the stack depths of the
+	// code. Handlers need them, but the maximum depth is best effort and unknown if the
+	// code is not valid. The prototype is verified along the way, so that Verify does not
+	// need to record anything in it once it is shared.
+	v, err := analyze(proto)
+	if err != nil && len(proto.handlers) > 0 {
+		return nil, err
+	}
+	if err == nil {
+		for i := range proto.handlers {
+			proto.handlers[i].height = v.heights[i]
+		}
+		proto.maxStack = v.maxDepth
+		proto.verified = verifyNested(proto) == nil
+	}
+	return proto, nil
+}
+
+// Name returns the name of the function prototype, or an empty string if unknown.
+func (p *FuncProto) Name() string {
+	return p.name
+}
+
+func (p *FuncProto) position(ip InstPtr) Position {
+	if int(ip) < len(p.positions) {
+		return p.positions[ip]
+	}
+	return Position{}
+}
+
+// constKey returns the key that identifies a constant in the pool, and whether it can be
+// deduplicated. Functions are identified by their prototype, so the same prototype is
+// never added twice. Floats are identified by their bits, so that -0.0 and 0.0 are kept
+// apart and NaN matches itself. Values with payloads that cannot be compared are never
+// deduplicated.
+func constKey(v Value) (any, bool) {
+	switch x := v.v.(type) {
+	case *Function:
+		return x.proto, true
+	case float32:
+		return [2]uint64{uint64(v.t), uint64(math.Float32bits(x))}, true
+	case float64:
+		return [2]uint64{uint64(v.t), math.Float64bits(x)}, true
+	}
+	if v.v != nil && !reflect.TypeOf(v.v).Comparable() {
+		return nil, false
+	}
+	return v, true
+}
+
+// handler is an exception handler of a function prototype.
+type handler struct {
+	start  InstPtr // first instruction of the protected region
+	end    InstPtr // first instruction after the protected region
+	target InstPtr // first instruction of the handler
+	height int     // lowest stack height of the region, relative to the frame base
+}
+
+type handlerLabels struct {
+	start, end, target FuncProtoLabel
 }
 
 type fixup struct {
 	refs  []InstPtr
 	value InstPtr
 }
+
+// upvalDesc describes how an upvalue is captured when a closure is created.
+type upvalDesc struct {
+	local bool // captures a stack slot of the enclosing frame, otherwise one of its upvalues
+	index int
+}
+
+// upvalue is a variable captured by a closure. While open, it refers to a slot of the stack
+// that owns the variable. Once that slot is released, it is closed and keeps its own copy.
+type upvalue struct {
+	stack *stack
+	idx   int
+	value Value
+	open  bool
+}
+
+func (u *upvalue) get() Value {
+	if u.open {
+		return u.stack.data[u.idx]
+	}
+	return u.value
+}
+
+func (u *upvalue) set(v Value) {
+	if u.open {
+		u.stack.data[u.idx] = v
+	} else {
+		u.value = v
+	}
+}
+
+func (u *upvalue) close() {
+	u.value = u.stack.data[u.idx]
+	u.open = false
+}
+
+// checkTypes checks the types of values against the declared ones, if any.
+func checkTypes(what string, values []Value, types []typeTag) error {
+	for i, t := range types {
+		if values[i].t != t {
+			return fmt.Errorf("%w: %s %d expected %s, got %s", ErrTypeMismatch, what, i, typeNames[t], typeNames[values[i].t])
+		}
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package stackvm_test
+
+import (
+	"math"
+	"testing"
+
+	"github.com/apoloval/stackvm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFuncProtoBuilder_AddConst(t *testing.T) {
+	inner, err := stackvm.NewFuncProto(0, func(b *stackvm.FuncProtoBuilder) {
+		b.Emit(stackvm.RET(0))
+	})
+	require.NoError(t, err)
+
+	_, err = stackvm.NewFuncProto(0, func(b *stackvm.FuncProtoBuilder) {
+		hello := b.AddConst(stackvm.NewString("hello"))
+		one := b.AddConst(stackvm.NewInt(1))
+		oneFloat := b.AddConst(stackvm.NewFloat(1))
+		proto := b.AddProto(inner)
+
+		assert.Equal(t, []int{0, 1, 2, 3}, []int{hello, one, oneFloat, proto})
+		assert.Equal(t, hello, b.AddConst(stackvm.NewString("hello")))
+		assert.Equal(t, one, b.AddConst(stackvm.NewInt(1)))
+		assert.Equal(t, proto, b.AddProto(inner))
+		b.Emit(stackvm.RET(0))
+	})
+	require.NoError(t, err)
+}
+
+// listError is an error whose value cannot be compared.
+type listError []error
+
+func (e listError) Error() string { return "list of errors" }
+
+func TestFuncProtoBuilder_AddConstKeys(t *testing.T) {
+	_, err := stackvm.NewFuncProto(0, func(b *stackvm.FuncProtoBuilder) {
+		zero := b.AddConst(stackvm.NewFloat64(0))
+		assert.NotEqual(t, zero, b.AddConst(stackvm.NewFloat64(math.Copysign(0, -1))))
+		assert.NotEqual(t, zero, b.AddConst(stackvm.NewFloat(0)))
+
+		nan := b.AddConst(stackvm.NewFloat(float32(math.NaN())))
+		assert.Equal(t, nan, b.AddConst(stackvm.NewFloat(float32(math.NaN()))))
+
+		list := stackvm.NewError(listError{assert.AnError})
+		assert.NotPanics(t, func() {
+			assert.NotEqual(t, b.AddConst(list), b.AddConst(list))
+		})
+		b.Emit(stackvm.RET(0))
+	})
+	require.NoError(t, err)
+}
+
+func TestFuncProtoBuilder_Locals(t *testing.T) {
+	_, err := stackvm.NewFuncProto(2, func(b *stackvm.FuncProtoBuilder) {
+		x := b.NewLocal("x")
+		assert.Equal(t, 2, x)
+
+		b.BeginScope()
+		shadow := b.NewLocal("x")
+		y := b.NewLocal("y")
+		assert.Equal(t, []int{3, 4}, []int{shadow, y})
+		slot, ok := b.Local("x")
+		assert.True(t, ok)
+		assert.Equal(t, shadow, slot)
+		b.EndScope()
+
+		slot, ok = b.Local("x")
+		assert.True(t, ok)
+		assert.Equal(t, x, slot)
+		_, ok = b.Local("y")
+		assert.False(t, ok)
+
+		assert.Equal(t, 5, b.NewLocal("z"))
+		b.Emit(stackvm.RET(0))
+	})
+	require.NoError(t, err)
+}
+
+func TestFuncProtoBuilder_Misuse(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		code func(b *stackvm.FuncProtoBuilder)
+		err  error
+	}{
+		{
+			name: "mark unknown label",
+			code: func(b *stackvm.FuncProtoBuilder) { b.Mark(stackvm.FuncProtoLabel(3)) },
+			err:  stackvm.ErrInvalidProgram,
+		},
+		{
+			name: "branch to unknown label",
+			code: func(b *stackvm.FuncProtoBuilder) { b.EmitBranch(stackvm.FuncProtoLabel(-1)) },
+			err:  stackvm.ErrInvalidProgram,
+		},
+		{
+			name: "handler with unknown label",
+			code: func(b *stackvm.FuncProtoBuilder) {
+				start := b.NewLabelFixed()
+				b.AddHandler(start, start, stackvm.FuncProtoLabel(7))
+			},
+			err: stackvm.ErrInvalidProgram,
+		},
+		{
+			name: "label not marked",
+			code: func(b *stackvm.FuncProtoBuilder) { b.EmitJump(b.NewLabel()) },
+			err:  stackvm.ErrInvalidProgram,
+		},
+		{
+			name: "return from try body with finally",
+			code: func(b *stackvm.FuncProtoBuilder) {
+				b.EmitTry(func() {
+					b.Emit(stackvm.PUSHI(1))
+					b.Emit(stackvm.RET(1))
+				}, nil, func() {
+					b.Emit(stackvm.NOP())
+				})
+				b.Emit(stackvm.RET(0))
+			},
+			err: stackvm.ErrInvalidProgram,
+		},
+		{
+			name: "return from catch block with finally",
+			code: func(b *stackvm.FuncProtoBuilder) {
+				b.EmitTry(func() {
+					b.Emit(stackvm.NOP())
+				}, func() {
+					b.Emit(stackvm.RET(1))
+				}, func() {
+					b.Emit(stackvm.NOP())
+				})
+				b.Emit(stackvm.RET(0))
+			},
+			err: stackvm.ErrInvalidProgram,
+		},
+		{
+			name: "nil nested prototype",
+			code: func(b *stackvm.FuncProtoBuilder) {
+				b.Emit(stackvm.PUSHK(b.AddProto(nil)))
+				b.Emit(stackvm.RET(1))
+			},
+			err: stackvm.ErrInternal,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var proto *stackvm.FuncProto
+			var err error
+			require.NotPanics(t, func() {
+				proto, err = stackvm.NewFuncProto(0, test.code)
+			})
+			assert.ErrorIs(t, err, test.err)
+			assert.Nil(t, proto)
+		})
+	}
+
+	t.Run("panic", func(t *testing.T) {
+		assert.PanicsWithValue(t, "boom", func() {
+			_, _ = stackvm.NewFuncProto(0, func(b *stackvm.FuncProtoBuilder) { panic("boom") })
+		})
+	})
+}
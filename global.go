@@ -0,0 +1,60 @@
+package stackvm
+
+import "fmt"
+
+// global is a global variable of a virtual machine.
+type global struct {
+	value    Value
+	readOnly bool
+}
+
+// SetGlobal sets the value of a global variable, defining it if needed. Global variables
+// are kept across runs, so they can be used to pass inputs to the bytecode and to share
+// state between runs.
+func (vm *VirtualMachine) SetGlobal(name string, v Value) {
+	vm.defineGlobal(name, v, false)
+}
+
+// SetReadOnlyGlobal sets the value of a global variable like SetGlobal, and marks it as
+// read-only for the bytecode. Setting it with SETGLOBAL fails with ErrReadOnlyGlobal.
+func (vm *VirtualMachine) SetReadOnlyGlobal(name string, v Value) {
+	vm.defineGlobal(name, v, true)
+}
+
+// Global returns the value of a global variable, and whether it is defined.
+func (vm *VirtualMachine) Global(name string) (Value, bool) {
+	g, ok := vm.globals[name]
+	return g.value, ok
+}
+
+func (vm *VirtualMachine) defineGlobal(name string, v Value, readOnly bool) {
+	if vm.globals == nil {
+		vm.globals = make(map[string]global)
+	}
+	vm.globals[name] = global{value: v, readOnly: readOnly}
+}
+
+// globalName returns the name of a global variable from the constant pool.
+func (vm *VirtualMachine) globalName(idx int) (string, error) {
+	k, err := vm.constant(idx)
+	if err != nil {
+		return "", err
+	}
+	return k.AsString()
+}
+
+func (vm *VirtualMachine) getGlobal(name string) (Value, error) {
+	g, ok := vm.globals[name]
+	if !ok {
+		return NoValue, fmt.Errorf("%w: %s", ErrUndefinedGlobal, name)
+	}
+	return g.value, nil
+}
+
+func (vm *VirtualMachine) setGlobal(name string, v Value) error {
+	if g, ok := vm.globals[name]; ok && g.readOnly {
+		return fmt.Errorf("%w: %s", ErrReadOnlyGlobal, name)
+	}
+	vm.defineGlobal(name, v, false)
+	return nil
+}
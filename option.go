@@ -1,19 +1,94 @@
 package stackvm
 
+import "strings"
+
 type settings struct {
-	stackLimit int
+	stackLimit  int
+	stackSize   int
+	callDepth   int
+	verify      bool
+	budget      uint64
+	costs       map[string]uint64
+	intMode     IntegerMode
+	floatPolicy FloatPolicy
 }
 
 // Option is a function that configures the virtual machine.
 type Option func(*settings)
 
-// WithStackLimit sets the limit of the stack.
+// WithStackLimit sets the hard limit of the stack, in values. The stack grows on demand up
+// to this limit, and pushing beyond it fails with ErrStackOverflow.
 func WithStackLimit(limit int) Option {
 	return func(vm *settings) {
 		vm.stackLimit = limit
 	}
 }
 
+// WithInitialStackSize sets the number of values the stack is allocated for when created,
+// before growing on demand. It is capped by the stack limit.
+func WithInitialStackSize(size int) Option {
+	return func(vm *settings) {
+		vm.stackSize = size
+	}
+}
+
+// WithCallDepthLimit sets the maximum number of nested function calls of a stack. Calls
+// beyond this limit fail with ErrStackOverflow. A zero limit means no limit.
+func WithCallDepthLimit(limit int) Option {
+	return func(vm *settings) {
+		vm.callDepth = limit
+	}
+}
+
+// WithVerification makes the virtual machine check every function prototype with Verify
+// before executing it for the first time.
+func WithVerification() Option {
+	return func(vm *settings) {
+		vm.verify = true
+	}
+}
+
+// WithInstructionLimit sets the budget of every run. Each executed instruction consumes
+// its cost from the budget, which is one unit unless set by WithInstructionCosts. A run
+// that exceeds its budget fails with ErrBudgetExceeded. A zero limit means no limit.
+func WithInstructionLimit(limit uint64) Option {
+	return func(vm *settings) {
+		vm.budget = limit
+	}
+}
+
+// WithInstructionCosts sets the budget cost of instructions, indexed by mnemonic (e.g.
+// "CALL"). Instructions not present in the table cost one unit, and unknown mnemonics
+// are ignored.
+func WithInstructionCosts(costs map[string]uint64) Option {
+	return func(vm *settings) {
+		if vm.costs == nil {
+			vm.costs = make(map[string]uint64, len(costs))
+		}
+		for mnemonic, cost := range costs {
+			vm.costs[strings.ToUpper(mnemonic)] = cost
+		}
+	}
+}
+
+// WithIntegerMode sets the behavior of integer arithmetic on overflow. Integers wrap
+// around by default. The checked instructions (ADDIC, SUBIC...) trap regardless of it.
+func WithIntegerMode(mode IntegerMode) Option {
+	return func(vm *settings) {
+		vm.intMode = mode
+	}
+}
+
+// WithFloatPolicy sets the behavior of float arithmetic on NaN and infinite results.
+// They are kept by default.
+func WithFloatPolicy(policy FloatPolicy) Option {
+	return func(vm *settings) {
+		vm.floatPolicy = policy
+	}
+}
+
 var defaultOpts = []Option{
 	WithStackLimit(256),
+	WithInitialStackSize(32),
+	WithCallDepthLimit(1024),
 }
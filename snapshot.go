@@ -0,0 +1,731 @@
+package stackvm
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"maps"
+	"slices"
+)
+
+// The snapshot of a run is laid out as follows:
+//
+//	magic    [4]byte  "SVMS"
+//	version  uint16   snapshot format version
+//	state    ...      run status, pending host results and budget used
+//	protos   ...      content hashes of the referenced prototypes
+//	hosts    ...      names of the referenced host functions
+//	objects  ...      kinds of the heap objects
+//	globals  ...      global variables, sorted by name
+//	contents ...      contents of the heap objects
+//	current  ...      the stack and the coroutine being executed
+//	checksum uint32   CRC-32 (IEEE) of all the preceding bytes
+//
+// Heap objects are stacks, upvalues, functions and coroutines. They are referenced by index,
+// so objects shared by several values are restored shared.
+const (
+	snapshotMagic   = "SVMS"
+	snapshotVersion = 3
+)
+
+type objKind byte
+
+const (
+	objStack objKind = iota
+	objUpvalue
+	objFunction
+	objCoroutine
+)
+
+// Snapshot encodes the state of the current run and the global variables, so it can be
+// restored later by Restore, possibly in another process. The run must be paused between
+// steps or suspended by a host function. Prototypes are referenced by content hash, and
+// host functions by name.
+func (vm *VirtualMachine) Snapshot() ([]byte, error) {
+	if vm.busy || vm.nested > 0 || (vm.status != StatusRunning && vm.status != StatusSuspended) {
+		return nil, fmt.Errorf("%w: no paused run to snapshot", ErrIllegalState)
+	}
+	w := &snapshotWriter{
+		protoIDs: make(map[*FuncProto]int),
+		hostIDs:  make(map[*HostFunction]int),
+		objIDs:   make(map[any]int),
+	}
+	current := w.id(vm.stack)
+	co := 0
+	if vm.co != nil {
+		co = w.id(vm.co) + 1
+	}
+	names := slices.Sorted(maps.Keys(vm.globals))
+	w.body.uvarint(len(names))
+	for _, name := range names {
+		g := vm.globals[name]
+		w.body.uvarint(len(name))
+		w.body.buf.WriteString(name)
+		w.body.bool(g.readOnly)
+		if err := w.value(g.value); err != nil {
+			return nil, err
+		}
+	}
+	for i := 0; i < len(w.objs); i++ {
+		if err := w.object(w.objs[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	var e encoder
+	e.buf.WriteString(snapshotMagic)
+	e.uint16(snapshotVersion)
+	e.buf.WriteByte(byte(vm.status))
+	e.uvarint(vm.pending)
+	e.uint64(vm.used)
+	e.uvarint(len(w.protos))
+	for _, p := range w.protos {
+		hash, err := p.hash()
+		if err != nil {
+			return nil, err
+		}
+		e.buf.Write(hash[:])
+	}
+	e.uvarint(len(w.hosts))
+	for _, h := range w.hosts {
+		e.uvarint(len(h.name))
+		e.buf.WriteString(h.name)
+	}
+	e.uvarint(len(w.objs))
+	for _, obj := range w.objs {
+		e.buf.WriteByte(byte(objKindOf(obj)))
+	}
+	e.buf.Write(w.body.buf.Bytes())
+	e.uvarint(current)
+	e.uvarint(co)
+	e.uint32(crc32.ChecksumIEEE(e.buf.Bytes()))
+	return e.buf.Bytes(), nil
+}
+
+// Restore restores a run encoded by Snapshot, so it can be continued by Step or RunUntil.
+// The global variables of the virtual machine are replaced by the ones of the snapshot.
+// The prototypes the run refers to are looked up by content hash among the given ones and
+// the prototypes nested in them, and host functions by name among the given ones and the
+// host function constants of the prototypes. Error values are restored with their message
+// only. It returns ErrInvalidSnapshot if the snapshot is corrupted or does not match the
+// given prototypes, or if it used more than the budget of the virtual machine.
+func (vm *VirtualMachine) Restore(data []byte, protos []*FuncProto, hosts ...Value) error {
+	if vm.busy || vm.status == StatusRunning || vm.status == StatusSuspended || vm.stack.currentFrame() != nil {
+		return fmt.Errorf("%w: VM is already running", ErrIllegalState)
+	}
+	r := &snapshotReader{
+		vm:     vm,
+		known:  make(map[[sha256.Size]byte]*FuncProto),
+		names:  make(map[string]*HostFunction),
+		decode: decoder{kind: ErrInvalidSnapshot},
+	}
+	for _, proto := range protos {
+		if vm.verify {
+			if err := Verify(proto); err != nil {
+				return err
+			}
+		}
+		if err := r.index(proto); err != nil {
+			return err
+		}
+	}
+	for _, v := range hosts {
+		fn, err := v.AsHostFunction()
+		if err != nil {
+			return err
+		}
+		r.names[fn.name] = fn
+	}
+	return r.restore(data)
+}
+
+func objKindOf(obj any) objKind {
+	switch obj.(type) {
+	case *stack:
+		return objStack
+	case *upvalue:
+		return objUpvalue
+	case *Function:
+		return objFunction
+	default:
+		return objCoroutine
+	}
+}
+
+type snapshotWriter struct {
+	body     encoder
+	protos   []*FuncProto
+	protoIDs map[*FuncProto]int
+	hosts    []*HostFunction
+	hostIDs  map[*HostFunction]int
+	objs     []any
+	objIDs   map[any]int
+}
+
+// id returns the index of a heap object, assigning a new one if not seen yet.
+func (w *snapshotWriter) id(obj any) int {
+	id, ok := w.objIDs[obj]
+	if !ok {
+		id = len(w.objs)
+		w.objIDs[obj] = id
+		w.objs = append(w.objs, obj)
+	}
+	return id
+}
+
+func (w *snapshotWriter) ref(obj any) {
+	w.body.uvarint(w.id(obj))
+}
+
+func (w *snapshotWriter) proto(p *FuncProto) {
+	id, ok := w.protoIDs[p]
+	if !ok {
+		id = len(w.protos)
+		w.protoIDs[p] = id
+		w.protos = append(w.protos, p)
+	}
+	w.body.uvarint(id)
+}
+
+func (w *snapshotWriter) host(h *HostFunction) {
+	id, ok := w.hostIDs[h]
+	if !ok {
+		id = len(w.hosts)
+		w.hostIDs[h] = id
+		w.hosts = append(w.hosts, h)
+	}
+	w.body.uvarint(id)
+}
+
+func (w *snapshotWriter) upvals(upvals []*upvalue) {
+	w.body.uvarint(len(upvals))
+	for _, uv := range upvals {
+		w.ref(uv)
+	}
+}
+
+func (w *snapshotWriter) object(obj any) error {
+	switch o := obj.(type) {
+	case *stack:
+		w.body.uvarint(len(o.data))
+		for _, v := range o.data {
+			if err := w.value(v); err != nil {
+				return err
+			}
+		}
+		w.body.uvarint(len(o.frames))
+		for _, f := range o.frames {
+			w.proto(f.proto)
+			w.body.uvarint(f.stackBase)
+			w.body.uvarint(int(f.ip))
+			w.body.uvarint(f.nres + 1)
+			w.upvals(f.upvals)
+			w.body.uvarint(len(f.varargs))
+			for _, v := range f.varargs {
+				if err := w.value(v); err != nil {
+					return err
+				}
+			}
+		}
+		w.upvals(o.upvals)
+	case *upvalue:
+		w.body.bool(o.open)
+		if !o.open {
+			return w.value(o.value)
+		}
+		w.ref(o.stack)
+		w.body.uvarint(o.idx)
+	case *Function:
+		w.proto(o.proto)
+		w.upvals(o.upvals)
+	case *Coroutine:
+		w.ref(o.fn)
+		w.ref(o.stack)
+		w.body.buf.WriteByte(byte(o.status))
+		w.body.bool(o.started)
+		w.body.bool(o.caller != nil)
+		if o.caller != nil {
+			w.ref(o.caller)
+		}
+		w.body.bool(o.callerCo != nil)
+		if o.callerCo != nil {
+			w.ref(o.callerCo)
+		}
+		w.body.uvarint(o.nres + 1)
+		w.body.uvarint(o.yieldRes)
+	}
+	return nil
+}
+
+func (w *snapshotWriter) value(v Value) error {
+	switch v.t {
+	case TypeFunction, TypeCoroutine:
+		w.body.buf.WriteByte(byte(v.t))
+		w.ref(v.v)
+	case TypeHostFunction:
+		w.body.buf.WriteByte(byte(v.t))
+		w.host(v.v.(*HostFunction))
+	case TypeError:
+		msg := v.v.(error).Error()
+		w.body.buf.WriteByte(byte(v.t))
+		w.body.uvarint(len(msg))
+		w.body.buf.WriteString(msg)
+	default:
+		return w.body.value(v)
+	}
+	return nil
+}
+
+type snapshotReader struct {
+	vm     *VirtualMachine
+	known  map[[sha256.Size]byte]*FuncProto
+	names  map[string]*HostFunction
+	decode decoder
+	protos []*FuncProto
+	hosts  []*HostFunction
+	objs   []any
+}
+
+// index registers a prototype, its nested prototypes and their host function constants.
+func (r *snapshotReader) index(p *FuncProto) error {
+	hash, err := p.hash()
+	if err != nil {
+		return err
+	}
+	if _, ok := r.known[hash]; ok {
+		return nil
+	}
+	r.known[hash] = p
+	for _, k := range p.constPool {
+		switch k.t {
+		case TypeFunction:
+			if err := r.index(k.v.(*Function).proto); err != nil {
+				return err
+			}
+		case TypeHostFunction:
+			fn := k.v.(*HostFunction)
+			r.names[fn.name] = fn
+		}
+	}
+	return nil
+}
+
+func (r *snapshotReader) errorf(format string, args ...any) error {
+	return r.decode.errorf(format, args...)
+}
+
+func (r *snapshotReader) restore(data []byte) error {
+	d := &r.decode
+	header := len(snapshotMagic) + 2
+	if len(data) < header+4 || string(data[:len(snapshotMagic)]) != snapshotMagic {
+		return r.errorf("bad magic number")
+	}
+	if v := binary.LittleEndian.Uint16(data[len(snapshotMagic):]); v != snapshotVersion {
+		return r.errorf("unsupported snapshot version %d", v)
+	}
+	body, sum := data[:len(data)-4], binary.LittleEndian.Uint32(data[len(data)-4:])
+	if crc32.ChecksumIEEE(body) != sum {
+		return r.errorf("checksum mismatch")
+	}
+	d.data, d.pos = body, header
+
+	b, err := d.byte()
+	if err != nil {
+		return err
+	}
+	status := Status(b)
+	if status != StatusRunning && status != StatusSuspended {
+		return r.errorf("invalid status %d", b)
+	}
+	pending, err := d.uvarint()
+	if err != nil {
+		return err
+	}
+	used, err := d.uint64()
+	if err != nil {
+		return err
+	}
+	if r.vm.budget > 0 && used > r.vm.budget {
+		return r.errorf("%d budget units used, limit is %d", used, r.vm.budget)
+	}
+	if err := r.header(); err != nil {
+		return err
+	}
+	globals, err := r.globals()
+	if err != nil {
+		return err
+	}
+	for _, obj := range r.objs {
+		if err := r.object(obj); err != nil {
+			return err
+		}
+	}
+	current, err := snapshotRef[*stack](r)
+	if err != nil {
+		return err
+	}
+	var co *Coroutine
+	if id, err := d.uvarint(); err != nil {
+		return err
+	} else if id > 0 {
+		obj, ok := r.objAt(id - 1)
+		if co, ok = obj.(*Coroutine); !ok {
+			return r.errorf("object %d is not a coroutine", id-1)
+		}
+	}
+	if d.pos != len(d.data) {
+		return r.errorf("trailing data")
+	}
+	if err := r.check(current, co); err != nil {
+		return err
+	}
+
+	r.vm.stack, r.vm.co = current, co
+	r.vm.status, r.vm.pending, r.vm.used = status, pending, used
+	r.vm.results = nil
+	r.vm.globals = globals
+	return nil
+}
+
+func (r *snapshotReader) globals() (map[string]global, error) {
+	d := &r.decode
+	n, err := d.count()
+	if err != nil {
+		return nil, err
+	}
+	globals := make(map[string]global, n)
+	for range n {
+		name, err := d.string()
+		if err != nil {
+			return nil, err
+		}
+		var g global
+		if g.readOnly, err = d.bool(); err != nil {
+			return nil, err
+		}
+		if g.value, err = r.value(); err != nil {
+			return nil, err
+		}
+		globals[name] = g
+	}
+	return globals, nil
+}
+
+// header decodes the referenced prototypes and host functions, and allocates the heap
+// objects to be decoded.
+func (r *snapshotReader) header() error {
+	d := &r.decode
+	nprotos, err := d.count()
+	if err != nil {
+		return err
+	}
+	r.protos = make([]*FuncProto, nprotos)
+	for i := range r.protos {
+		b, err := d.bytes(sha256.Size)
+		if err != nil {
+			return err
+		}
+		hash := [sha256.Size]byte(b)
+		if r.protos[i] = r.known[hash]; r.protos[i] == nil {
+			return r.errorf("unknown prototype %x", hash)
+		}
+	}
+	nhosts, err := d.count()
+	if err != nil {
+		return err
+	}
+	r.hosts = make([]*HostFunction, nhosts)
+	for i := range r.hosts {
+		name, err := d.string()
+		if err != nil {
+			return err
+		}
+		if r.hosts[i] = r.names[name]; r.hosts[i] == nil {
+			return r.errorf("unknown host function %s", name)
+		}
+	}
+	nobjs, err := d.count()
+	if err != nil {
+		return err
+	}
+	r.objs = make([]any, nobjs)
+	for i := range r.objs {
+		kind, err := d.byte()
+		if err != nil {
+			return err
+		}
+		switch objKind(kind) {
+		case objStack:
+			r.objs[i] = r.vm.newStack()
+		case objUpvalue:
+			r.objs[i] = &upvalue{}
+		case objFunction:
+			r.objs[i] = &Function{}
+		case objCoroutine:
+			r.objs[i] = &Coroutine{vm: r.vm}
+		default:
+			return r.errorf("invalid object kind %d", kind)
+		}
+	}
+	return nil
+}
+
+func (r *snapshotReader) objAt(id int) (any, bool) {
+	if id < 0 || id >= len(r.objs) {
+		return nil, false
+	}
+	return r.objs[id], true
+}
+
+// snapshotRef decodes a reference to a heap object of the given type.
+func snapshotRef[T any](r *snapshotReader) (T, error) {
+	var zero T
+	id, err := r.decode.uvarint()
+	if err != nil {
+		return zero, err
+	}
+	obj, _ := r.objAt(id)
+	o, ok := obj.(T)
+	if !ok {
+		return zero, r.errorf("object %d has unexpected kind", id)
+	}
+	return o, nil
+}
+
+func (r *snapshotReader) proto() (*FuncProto, error) {
+	id, err := r.decode.uvarint()
+	if err != nil {
+		return nil, err
+	}
+	if id >= len(r.protos) {
+		return nil, r.errorf("prototype %d out of range", id)
+	}
+	return r.protos[id], nil
+}
+
+func (r *snapshotReader) upvals() ([]*upvalue, error) {
+	n, err := r.decode.count()
+	if err != nil {
+		return nil, err
+	}
+	upvals := make([]*upvalue, n)
+	for i := range upvals {
+		if upvals[i], err = snapshotRef[*upvalue](r); err != nil {
+			return nil, err
+		}
+	}
+	return upvals, nil
+}
+
+func (r *snapshotReader) object(obj any) (err error) {
+	d := &r.decode
+	switch o := obj.(type) {
+	case *stack:
+		n, err := d.count()
+		if err != nil {
+			return err
+		}
+		if n > o.limit {
+			return r.errorf("stack of %d values exceeds the limit of %d", n, o.limit)
+		}
+		for range n {
+			v, err := r.value()
+			if err != nil {
+				return err
+			}
+			o.data = append(o.data, v)
+		}
+		nframes, err := d.count()
+		if err != nil {
+			return err
+		}
+		if o.maxFrames > 0 && nframes > o.maxFrames {
+			return r.errorf("%d frames exceed the call depth limit of %d", nframes, o.maxFrames)
+		}
+		o.frames = make([]frame, nframes)
+		for i := range o.frames {
+			f := &o.frames[i]
+			if f.proto, err = r.proto(); err != nil {
+				return err
+			}
+			if f.stackBase, err = d.uvarint(); err != nil {
+				return err
+			}
+			ip, err := d.uvarint()
+			if err != nil {
+				return err
+			}
+			f.ip = InstPtr(ip)
+			if f.nres, err = d.uvarint(); err != nil {
+				return err
+			}
+			f.nres--
+			if f.upvals, err = r.upvals(); err != nil {
+				return err
+			}
+			nvarargs, err := d.count()
+			if err != nil {
+				return err
+			}
+			for range nvarargs {
+				v, err := r.value()
+				if err != nil {
+					return err
+				}
+				f.varargs = append(f.varargs, v)
+			}
+			if f.stackBase > len(o.data) || ip > len(f.proto.bytecode) {
+				return r.errorf("frame %d out of range", i)
+			}
+		}
+		o.upvals, err = r.upvals()
+		return err
+	case *upvalue:
+		if o.open, err = d.bool(); err != nil {
+			return err
+		}
+		if !o.open {
+			o.value, err = r.value()
+			return err
+		}
+		if o.stack, err = snapshotRef[*stack](r); err != nil {
+			return err
+		}
+		o.idx, err = d.uvarint()
+		return err
+	case *Function:
+		if o.proto, err = r.proto(); err != nil {
+			return err
+		}
+		o.upvals, err = r.upvals()
+		return err
+	case *Coroutine:
+		return r.coroutine(o)
+	}
+	return nil
+}
+
+func (r *snapshotReader) coroutine(co *Coroutine) (err error) {
+	d := &r.decode
+	if co.fn, err = snapshotRef[*Function](r); err != nil {
+		return err
+	}
+	if co.stack, err = snapshotRef[*stack](r); err != nil {
+		return err
+	}
+	status, err := d.byte()
+	if err != nil {
+		return err
+	}
+	if co.status = CoroutineStatus(status); co.status > CoroutineDead {
+		return r.errorf("invalid coroutine status %d", status)
+	}
+	if co.started, err = d.bool(); err != nil {
+		return err
+	}
+	if ok, err := d.bool(); err != nil {
+		return err
+	} else if ok {
+		if co.caller, err = snapshotRef[*stack](r); err != nil {
+			return err
+		}
+	}
+	if ok, err := d.bool(); err != nil {
+		return err
+	} else if ok {
+		if co.callerCo, err = snapshotRef[*Coroutine](r); err != nil {
+			return err
+		}
+	}
+	if co.nres, err = d.uvarint(); err != nil {
+		return err
+	}
+	co.nres--
+	co.yieldRes, err = d.uvarint()
+	return err
+}
+
+func (r *snapshotReader) value() (Value, error) {
+	d := &r.decode
+	tag, err := d.byte()
+	if err != nil {
+		return NoValue, err
+	}
+	switch typeTag(tag) {
+	case TypeFunction:
+		fn, err := snapshotRef[*Function](r)
+		return newValue(TypeFunction, fn), err
+	case TypeCoroutine:
+		co, err := snapshotRef[*Coroutine](r)
+		return newValue(TypeCoroutine, co), err
+	case TypeHostFunction:
+		id, err := d.uvarint()
+		if err != nil {
+			return NoValue, err
+		}
+		if id >= len(r.hosts) {
+			return NoValue, r.errorf("host function %d out of range", id)
+		}
+		return newValue(TypeHostFunction, r.hosts[id]), nil
+	case TypeError:
+		msg, err := d.string()
+		return NewError(errors.New(msg)), err
+	default:
+		return d.scalar(typeTag(tag))
+	}
+}
+
+// check validates the consistency of the decoded objects, so the restored run cannot
+// access the stacks out of range nor loop forever unwinding the resumed coroutines.
+func (r *snapshotReader) check(current *stack, co *Coroutine) error {
+	if current.currentFrame() == nil {
+		return r.errorf("no frame to continue")
+	}
+	if co != nil && co.stack != current {
+		return r.errorf("current coroutine does not own the current stack")
+	}
+	// The chain of resumers is walked when unwinding the run, so it must end.
+	visited := make(map[*Coroutine]bool)
+	for c := co; c != nil; c = c.callerCo {
+		if visited[c] {
+			return r.errorf("cyclic chain of resumed coroutines")
+		}
+		visited[c] = true
+		if c.status != CoroutineRunning {
+			return r.errorf("resumed coroutine is %s", c.status)
+		}
+		if c.callerCo != nil && c.caller != c.callerCo.stack {
+			return r.errorf("resumed coroutine returns to another stack than its resumer")
+		}
+	}
+	listed := make(map[*upvalue]bool)
+	for i, obj := range r.objs {
+		if s, ok := obj.(*stack); ok {
+			for j, uv := range s.upvals {
+				if !uv.open || uv.stack != s || (j > 0 && s.upvals[j-1].idx >= uv.idx) {
+					return r.errorf("stack %d has inconsistent open upvalues", i)
+				}
+				listed[uv] = true
+			}
+		}
+	}
+	for i, obj := range r.objs {
+		switch o := obj.(type) {
+		case *upvalue:
+			// Open upvalues must be closed by their stack when their slot is released.
+			if o.open && (!listed[o] || o.idx >= len(o.stack.data)) {
+				return r.errorf("upvalue %d out of range", i)
+			}
+		case *Coroutine:
+			if o.stack == current && o != co {
+				return r.errorf("coroutine %d owns the current stack but is not current", i)
+			}
+			if started := len(o.stack.frames) > 0; o.status == CoroutineSuspended && started != o.started {
+				return r.errorf("coroutine %d has inconsistent stack", i)
+			}
+		}
+	}
+	return nil
+}
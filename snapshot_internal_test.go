@@ -0,0 +1,85 @@
+package stackvm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVM_RestoreCorruptedCoroutines(t *testing.T) {
+	fetch := NewHostFunction("fetch", func(vm *VirtualMachine, args []Value) ([]Value, error) {
+		return nil, vm.Suspend()
+	})
+
+	// gen() { fetch(); return 1 }
+	gen, err := NewFuncProto(0, func(b *FuncProtoBuilder) {
+		b.Emit(PUSHK(b.AddConst(fetch)))
+		b.Emit(CALL(0, 0))
+		b.Emit(PUSHI(1))
+		b.Emit(RET(1))
+	})
+	require.NoError(t, err)
+
+	// main() { return resume(coroutine(gen)) }
+	main, err := NewFuncProto(0, func(b *FuncProtoBuilder) {
+		b.Emit(PUSHK(b.AddProto(gen)))
+		b.Emit(COROUTINE())
+		b.Emit(RESUME(0, 1))
+		b.Emit(RET(1))
+	})
+	require.NoError(t, err)
+
+	for _, test := range []struct {
+		name    string
+		corrupt func(vm *VirtualMachine)
+		msg     string
+	}{
+		{
+			name: "cyclic resumers",
+			corrupt: func(vm *VirtualMachine) {
+				vm.co.caller, vm.co.callerCo = vm.co.stack, vm.co
+			},
+			msg: "cyclic chain of resumed coroutines",
+		},
+		{
+			name: "resumer of another stack",
+			corrupt: func(vm *VirtualMachine) {
+				other := &Coroutine{vm: vm, fn: vm.co.fn, stack: vm.newStack(), status: CoroutineRunning}
+				vm.co.callerCo = other
+			},
+			msg: "resumed coroutine returns to another stack than its resumer",
+		},
+		{
+			name: "current stack not owned",
+			corrupt: func(vm *VirtualMachine) {
+				vm.SetGlobal("co", newValue(TypeCoroutine, vm.co))
+				vm.co = nil
+			},
+			msg: "owns the current stack but is not current",
+		},
+		{
+			name: "current coroutine on another stack",
+			corrupt: func(vm *VirtualMachine) {
+				vm.stack = vm.co.caller
+			},
+			msg: "current coroutine does not own the current stack",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			vm := New()
+			_, err := vm.Run(main)
+			require.ErrorIs(t, err, ErrSuspended)
+			require.NotNil(t, vm.co)
+			test.corrupt(vm)
+			data, err := vm.Snapshot()
+			require.NoError(t, err)
+
+			restored := New()
+			err = restored.Restore(data, []*FuncProto{main})
+			require.ErrorIs(t, err, ErrInvalidSnapshot)
+			assert.ErrorContains(t, err, test.msg)
+			assert.Equal(t, StatusIdle, restored.Status())
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package stackvm_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/apoloval/stackvm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVM_SnapshotRestore(t *testing.T) {
+	fetch := stackvm.NewHostFunction("fetch", func(vm *stackvm.VirtualMachine, args []stackvm.Value) ([]stackvm.Value, error) {
+		return nil, vm.Suspend()
+	})
+
+	// gen() { yield 1; yield 2; return 3 }
+	gen, err := stackvm.NewFuncProto(0, func(b *stackvm.FuncProtoBuilder) {
+		b.Emit(stackvm.PUSHI(1))
+		b.Emit(stackvm.YIELD(1, 0))
+		b.Emit(stackvm.PUSHI(2))
+		b.Emit(stackvm.YIELD(1, 0))
+		b.Emit(stackvm.PUSHI(3))
+		b.Emit(stackvm.RET(1))
+	})
+	require.NoError(t, err)
+
+	// main(a) { co := coroutine(gen); x := resume(co); dbl := func() { return a * 2 };
+	//           y := fetch(a); z := resume(co); return y + z + x + dbl() }
+	main, err := stackvm.NewFuncProto(1, func(b *stackvm.FuncProtoBuilder) {
+		dbl, err := stackvm.NewFuncProto(0, func(b *stackvm.FuncProtoBuilder) {
+			a := b.CaptureLocal(0)
+			b.Emit(stackvm.GETUPVAL(a))
+			b.Emit(stackvm.PUSHI(2))
+			b.Emit(stackvm.MULI())
+			b.Emit(stackvm.RET(1))
+		})
+		require.NoError(t, err)
+		b.Emit(stackvm.PUSHK(b.AddProto(gen)))
+		b.Emit(stackvm.COROUTINE())
+		b.Emit(stackvm.DUP(1))
+		b.Emit(stackvm.RESUME(0, 1))
+		b.Emit(stackvm.CLOSURE(b.AddProto(dbl)))
+		b.Emit(stackvm.DUP(0))
+		b.Emit(stackvm.PUSHK(b.AddConst(fetch)))
+		b.Emit(stackvm.CALL(1, 1))
+		b.Emit(stackvm.DUP(1))
+		b.Emit(stackvm.RESUME(0, 1))
+		b.Emit(stackvm.ADDI())
+		b.Emit(stackvm.DUP(2))
+		b.Emit(stackvm.ADDI())
+		b.Emit(stackvm.DUP(3))
+		b.Emit(stackvm.CALL(0, 1))
+		b.Emit(stackvm.ADDI())
+		b.Emit(stackvm.RET(1))
+	})
+	require.NoError(t, err)
+
+	vm := stackvm.New(stackvm.WithVerification())
+	vm.SetReadOnlyGlobal("mode", stackvm.NewString("batch"))
+	_, err = vm.Run(main, stackvm.NewInt(5))
+	require.ErrorIs(t, err, stackvm.ErrSuspended)
+	data, err := vm.Snapshot()
+	require.NoError(t, err)
+
+	t.Run("restore in another VM", func(t *testing.T) {
+		restored := stackvm.New(stackvm.WithVerification())
+		require.NoError(t, restored.Restore(data, []*stackvm.FuncProto{main}))
+		assert.Equal(t, stackvm.StatusSuspended, restored.Status())
+		mode, ok := restored.Global("mode")
+		assert.True(t, ok)
+		assert.Equal(t, stackvm.NewString("batch"), mode)
+		require.NoError(t, restored.Resume(stackvm.NewInt(10)))
+		values, err := restored.RunUntil(context.Background(), nil)
+		require.NoError(t, err)
+		assert.Equal(t, []stackvm.Value{stackvm.NewInt(10 + 2 + 1 + 10)}, values)
+	})
+
+	t.Run("original VM is not affected", func(t *testing.T) {
+		again, err := vm.Snapshot()
+		require.NoError(t, err)
+		assert.Equal(t, data, again)
+	})
+
+	t.Run("restore while paused between steps", func(t *testing.T) {
+		vm := stackvm.New()
+		require.NoError(t, vm.Start(gen))
+		require.NoError(t, vm.Step())
+		data, err := vm.Snapshot()
+		require.NoError(t, err)
+
+		restored := stackvm.New()
+		require.NoError(t, restored.Restore(data, []*stackvm.FuncProto{gen}))
+		assert.Equal(t, vm.Location(), restored.Location())
+	})
+
+	t.Run("different bytecode", func(t *testing.T) {
+		restored := stackvm.New()
+		err := restored.Restore(data, []*stackvm.FuncProto{gen})
+		assert.ErrorIs(t, err, stackvm.ErrInvalidSnapshot)
+		assert.Equal(t, stackvm.StatusIdle, restored.Status())
+	})
+
+	t.Run("over budget", func(t *testing.T) {
+		used := vm.BudgetUsed()
+		require.NotZero(t, used)
+		restored := stackvm.New(stackvm.WithInstructionLimit(used - 1))
+		err := restored.Restore(data, []*stackvm.FuncProto{main})
+		assert.ErrorIs(t, err, stackvm.ErrInvalidSnapshot)
+		assert.Equal(t, stackvm.StatusIdle, restored.Status())
+
+		restored = stackvm.New(stackvm.WithInstructionLimit(used))
+		require.NoError(t, restored.Restore(data, []*stackvm.FuncProto{main}))
+	})
+
+	t.Run("corrupted data", func(t *testing.T) {
+		corrupted := append([]byte(nil), data...)
+		corrupted[len(corrupted)/2] ^= 0xFF
+		err := stackvm.New().Restore(corrupted, []*stackvm.FuncProto{main})
+		assert.ErrorIs(t, err, stackvm.ErrInvalidSnapshot)
+	})
+
+	t.Run("no run", func(t *testing.T) {
+		_, err := stackvm.New().Snapshot()
+		assert.ErrorIs(t, err, stackvm.ErrIllegalState)
+	})
+}
@@ -1,26 +1,72 @@
 package stackvm
 
+import (
+	"fmt"
+	"slices"
+)
+
 type stack struct {
-	data   []Value
-	frames []frame
-	limit  int
+	data      []Value
+	frames    []frame
+	limit     int        // maximum number of values, the data grows on demand up to it
+	maxFrames int        // maximum number of frames, zero if unlimited
+	upvals    []*upvalue // open upvalues, sorted by stack index
 }
 
 func newStack(limit int) *stack {
 	s := &stack{
-		data:  make([]Value, 0, limit),
 		limit: limit,
 	}
 	return s
 }
 
-func (s *stack) newFrame(proto *FuncProto) *frame {
+// newFrame pushes a new frame for the given prototype, whose nargs arguments are on top of
+// the stack, and reserves its local slots. The arguments beyond the fixed parameters of a
+// variadic prototype are moved from the stack to the frame, and the fixed ones are checked
+// against the declared parameter types, if any. If the maximum stack depth of
+// the prototype is known, the frame fails to be pushed if it does not fit in the stack,
+// and the stack is grown to fit it otherwise.
+func (s *stack) newFrame(proto *FuncProto, nargs int) (*frame, error) {
+	if proto.variadic && nargs < proto.nargs {
+		return nil, fmt.Errorf("%w: expected at least %d arguments, got %d", ErrArityMismatch, proto.nargs, nargs)
+	}
+	if !proto.variadic && nargs != proto.nargs {
+		return nil, fmt.Errorf("%w: expected %d arguments, got %d", ErrArityMismatch, proto.nargs, nargs)
+	}
+	if s.maxFrames > 0 && len(s.frames) >= s.maxFrames {
+		return nil, fmt.Errorf("%w: call depth limit of %d exceeded", ErrStackOverflow, s.maxFrames)
+	}
+	bottom := 0
+	if frame := s.currentFrame(); frame != nil {
+		bottom = frame.stackBase
+	}
+	if len(s.data)-nargs < bottom {
+		return nil, ErrStackUnderflow
+	}
+	base := len(s.data) - nargs
+	if err := checkTypes("argument", s.data[base:], proto.paramTypes); err != nil {
+		return nil, err
+	}
+	size := max(proto.maxStack, proto.nargs+proto.nlocals)
+	if base+size > s.limit {
+		return nil, fmt.Errorf("%w: frame needs %d slots, %d available", ErrStackOverflow, size, s.limit-base)
+	}
+	var varargs []Value
+	if nargs > proto.nargs {
+		varargs, _ = s.popN(nargs - proto.nargs)
+	}
+	s.data = slices.Grow(s.data, base+size-len(s.data))
+	for range proto.nlocals {
+		s.data = append(s.data, NoValue)
+	}
 	s.frames = append(s.frames, frame{
 		proto:     proto,
-		stackBase: len(s.data) - proto.nargs,
+		stackBase: base,
 		ip:        0,
+		nres:      anyResults,
+		varargs:   varargs,
 	})
-	return &s.frames[len(s.frames)-1]
+	return &s.frames[len(s.frames)-1], nil
 }
 
 func (s *stack) unwindFrame(nres int) (f frame, err error) {
@@ -30,12 +76,26 @@ func (s *stack) unwindFrame(nres int) (f frame, err error) {
 	} else {
 		f = *frame
 	}
+	if nres < 0 || nres > len(s.data)-f.stackBase {
+		err = ErrStackUnderflow
+		return
+	}
+	if f.proto.hasResults && f.proto.nresults != nres {
+		err = fmt.Errorf("%w: function declares %d results, returns %d", ErrArityMismatch, f.proto.nresults, nres)
+		return
+	}
+	if f.nres != anyResults && f.nres != nres {
+		err = fmt.Errorf("%w: expected %d results, got %d", ErrArityMismatch, f.nres, nres)
+		return
+	}
+	if err = checkTypes("result", s.data[len(s.data)-nres:], f.proto.resultTypes); err != nil {
+		return
+	}
 	s.frames = s.frames[:len(s.frames)-1]
+	s.closeUpvalues(f.stackBase)
 
-	// displace the last nres items from the stack to the base
-	for i := 0; i < nres; i++ {
-		s.data[f.stackBase+i] = s.data[len(s.data)-1-i]
-	}
+	// displace the last nres items from the stack to the base, keeping their order
+	copy(s.data[f.stackBase:], s.data[len(s.data)-nres:])
 	s.data = s.data[:f.stackBase+nres]
 
 	return
@@ -89,10 +149,23 @@ func (s *stack) pop() (Value, error) {
 		return NoValue, ErrStackUnderflow
 	}
 	item := s.data[len(s.data)-1]
+	s.closeUpvalues(len(s.data) - 1)
 	s.data = s.data[:len(s.data)-1]
 	return item, nil
 }
 
+func (s *stack) popN(n int) ([]Value, error) {
+	frame := s.currentFrame()
+	if n < 0 || len(s.data) < n || (frame != nil && len(s.data)-n < frame.stackBase) {
+		return nil, ErrStackUnderflow
+	}
+	values := make([]Value, n)
+	copy(values, s.data[len(s.data)-n:])
+	s.closeUpvalues(len(s.data) - n)
+	s.data = s.data[:len(s.data)-n]
+	return values, nil
+}
+
 func (s *stack) popInt() (int32, error) {
 	item, err := s.pop()
 	if err != nil {
@@ -109,6 +182,22 @@ func (s *stack) popFloat() (float32, error) {
 	return item.AsFloat()
 }
 
+func (s *stack) popInt64() (int64, error) {
+	item, err := s.pop()
+	if err != nil {
+		return 0, err
+	}
+	return item.AsInt64()
+}
+
+func (s *stack) popFloat64() (float64, error) {
+	item, err := s.pop()
+	if err != nil {
+		return 0, err
+	}
+	return item.AsFloat64()
+}
+
 func (s *stack) popBool() (bool, error) {
 	item, err := s.pop()
 	if err != nil {
@@ -132,14 +221,58 @@ func (s *stack) popAll() []Value {
 	}
 	values := make([]Value, len(s.data)-base)
 	copy(values, s.data[base:])
+	s.closeUpvalues(base)
 	s.data = s.data[:base]
 	return values
 }
 
+// reset clears the frames and values of the stack, closing its open upvalues, and keeps
+// its allocated memory for reuse.
+func (s *stack) reset() {
+	s.closeUpvalues(0)
+	clear(s.data)
+	clear(s.frames)
+	s.data = s.data[:0]
+	s.frames = s.frames[:0]
+}
+
+// anyResults is the expected result count of a frame that accepts any number of results.
+const anyResults = -1
+
+// capture returns the open upvalue for the given stack index, creating it if needed.
+func (s *stack) capture(idx int) *upvalue {
+	i := len(s.upvals)
+	for i > 0 && s.upvals[i-1].idx >= idx {
+		if s.upvals[i-1].idx == idx {
+			return s.upvals[i-1]
+		}
+		i--
+	}
+	uv := &upvalue{stack: s, idx: idx, open: true}
+	s.upvals = append(s.upvals, nil)
+	copy(s.upvals[i+1:], s.upvals[i:])
+	s.upvals[i] = uv
+	return uv
+}
+
+// closeUpvalues closes the open upvalues that refer to stack indices at or above level.
+func (s *stack) closeUpvalues(level int) {
+	i := len(s.upvals)
+	for i > 0 && s.upvals[i-1].idx >= level {
+		s.upvals[i-1].close()
+		s.upvals[i-1] = nil
+		i--
+	}
+	s.upvals = s.upvals[:i]
+}
+
 type frame struct {
 	proto     *FuncProto
 	stackBase int
 	ip        InstPtr
+	nres      int
+	upvals    []*upvalue
+	varargs   []Value // arguments beyond the fixed parameters of a variadic prototype
 }
 
 func (f *frame) nextInst() (Inst, bool) {
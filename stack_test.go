@@ -44,8 +44,51 @@ func TestStack_UnderflowEmpty(t *testing.T) {
 func TestStack_UnderflowBase(t *testing.T) {
 	stack := newStack(1)
 	stack.push(NewString("Hello"))
-	stack.newFrame(&FuncProto{nargs: 0})
+	stack.newFrame(&FuncProto{nargs: 0}, 0)
 
 	_, err := stack.pop()
 	assert.EqualError(t, err, ErrStackUnderflow.Error())
 }
+
+func TestStack_UpvalueClosedOnPop(t *testing.T) {
+	stack := newStack(2)
+	stack.push(NewInt(1))
+	stack.push(NewInt(2))
+
+	uv := stack.capture(1)
+	assert.Same(t, uv, stack.capture(1))
+	uv.set(NewInt(3))
+
+	item, err := stack.pop()
+	require.NoError(t, err)
+	assert.Equal(t, NewInt(3), item)
+	assert.False(t, uv.open)
+
+	stack.push(NewInt(4))
+	assert.Equal(t, NewInt(3), uv.get())
+}
+
+func TestStack_NewFrameReservesMaxStack(t *testing.T) {
+	stack := newStack(8)
+	stack.push(NewInt(1))
+
+	_, err := stack.newFrame(&FuncProto{nargs: 1, maxStack: 9}, 1)
+	assert.ErrorIs(t, err, ErrStackOverflow)
+	assert.Empty(t, stack.frames)
+
+	_, err = stack.newFrame(&FuncProto{nargs: 1, maxStack: 8}, 1)
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, cap(stack.data), 8)
+}
+
+func TestStack_NewFrameDepthLimit(t *testing.T) {
+	stack := newStack(8)
+	stack.maxFrames = 2
+
+	for range 2 {
+		_, err := stack.newFrame(&FuncProto{}, 0)
+		require.NoError(t, err)
+	}
+	_, err := stack.newFrame(&FuncProto{}, 0)
+	assert.ErrorIs(t, err, ErrStackOverflow)
+}
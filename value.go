@@ -1,6 +1,9 @@
 package stackvm
 
-import "fmt"
+import (
+	"fmt"
+	"strconv"
+)
 
 // Value is a value that can be stored in the stack and manipulated by the virtual machine.
 type Value struct {
@@ -21,6 +24,18 @@ func NewFloat(v float32) Value {
 	return newValue(TypeFloat, v)
 }
 
+// NewInt64 creates a new 64-bit int value. Instructions can only hold 32-bit immediates,
+// so 64-bit values are loaded from the constant pool by PUSHK.
+func NewInt64(v int64) Value {
+	return newValue(TypeInt64, v)
+}
+
+// NewFloat64 creates a new 64-bit float value. Instructions can only hold 32-bit
+// immediates, so 64-bit values are loaded from the constant pool by PUSHK.
+func NewFloat64(v float64) Value {
+	return newValue(TypeFloat64, v)
+}
+
 // NewBool creates a new bool value.
 func NewBool(v bool) Value {
 	return newValue(TypeBool, v)
@@ -37,6 +52,29 @@ func NewFunction(vm *VirtualMachine, proto *FuncProto) Value {
 	return newValue(TypeFunction, f)
 }
 
+// NewHostFunction creates a new host function value.
+func NewHostFunction(name string, fn HostFunc) Value {
+	f := &HostFunction{name: name, fn: fn}
+	return newValue(TypeHostFunction, f)
+}
+
+// NewCoroutine creates a new coroutine value that executes the given function on the
+// given virtual machine. The coroutine starts suspended, and runs the function when it is
+// resumed for the first time.
+func NewCoroutine(vm *VirtualMachine, fn Value) (Value, error) {
+	co, err := vm.newCoroutine(fn)
+	if err != nil {
+		return NoValue, err
+	}
+	return newValue(TypeCoroutine, co), nil
+}
+
+// NewError creates a new error value. Error values are raised as exceptions by runtime
+// faults, such as type mismatches, so they can be caught by exception handlers.
+func NewError(err error) Value {
+	return newValue(TypeError, err)
+}
+
 // AsInt returns the value as an int.
 func (v Value) AsInt() (int32, error) {
 	if err := v.ensureType(TypeInt); err != nil {
@@ -53,6 +91,22 @@ func (v Value) AsFloat() (float32, error) {
 	return v.v.(float32), nil
 }
 
+// AsInt64 returns the value as a 64-bit int.
+func (v Value) AsInt64() (int64, error) {
+	if err := v.ensureType(TypeInt64); err != nil {
+		return 0, err
+	}
+	return v.v.(int64), nil
+}
+
+// AsFloat64 returns the value as a 64-bit float.
+func (v Value) AsFloat64() (float64, error) {
+	if err := v.ensureType(TypeFloat64); err != nil {
+		return 0, err
+	}
+	return v.v.(float64), nil
+}
+
 // AsBool returns the value as a bool.
 func (v Value) AsBool() (bool, error) {
 	if err := v.ensureType(TypeBool); err != nil {
@@ -69,6 +123,59 @@ func (v Value) AsString() (string, error) {
 	return v.v.(string), nil
 }
 
+// AsFunction returns the value as a function.
+func (v Value) AsFunction() (*Function, error) {
+	if err := v.ensureType(TypeFunction); err != nil {
+		return nil, err
+	}
+	return v.v.(*Function), nil
+}
+
+// AsHostFunction returns the value as a host function.
+func (v Value) AsHostFunction() (*HostFunction, error) {
+	if err := v.ensureType(TypeHostFunction); err != nil {
+		return nil, err
+	}
+	return v.v.(*HostFunction), nil
+}
+
+// AsCoroutine returns the value as a coroutine.
+func (v Value) AsCoroutine() (*Coroutine, error) {
+	if err := v.ensureType(TypeCoroutine); err != nil {
+		return nil, err
+	}
+	return v.v.(*Coroutine), nil
+}
+
+// AsError returns the value as an error.
+func (v Value) AsError() (error, error) {
+	if err := v.ensureType(TypeError); err != nil {
+		return nil, err
+	}
+	return v.v.(error), nil
+}
+
+// String returns a human-readable representation of the value.
+func (v Value) String() string {
+	switch v.t {
+	case TypeNone:
+		return "none"
+	case TypeString:
+		return strconv.Quote(v.v.(string))
+	case TypeFunction:
+		if name := v.v.(*Function).proto.name; name != "" {
+			return "function " + name
+		}
+		return "function"
+	case TypeHostFunction:
+		return "host function " + v.v.(*HostFunction).name
+	case TypeCoroutine:
+		return "coroutine " + v.v.(*Coroutine).status.String()
+	default:
+		return fmt.Sprint(v.v)
+	}
+}
+
 func newValue(t typeTag, v any) Value {
 	return Value{t: t, v: v}
 }
@@ -89,13 +196,23 @@ const (
 	TypeBool
 	TypeString
 	TypeFunction
+	TypeHostFunction
+	TypeError
+	TypeCoroutine
+	TypeInt64
+	TypeFloat64
 )
 
 var typeNames = map[typeTag]string{
-	TypeNone:     "none",
-	TypeInt:      "int",
-	TypeFloat:    "float",
-	TypeBool:     "bool",
-	TypeString:   "string",
-	TypeFunction: "function",
+	TypeNone:         "none",
+	TypeInt:          "int",
+	TypeFloat:        "float",
+	TypeBool:         "bool",
+	TypeString:       "string",
+	TypeFunction:     "function",
+	TypeHostFunction: "host function",
+	TypeError:        "error",
+	TypeCoroutine:    "coroutine",
+	TypeInt64:        "int64",
+	TypeFloat64:      "float64",
 }
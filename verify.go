@@ -0,0 +1,297 @@
+package stackvm
+
+import (
+	"fmt"
+	"math"
+)
+
+// Verify statically checks a function prototype and all the prototypes nested in its
+// constant pool. It ensures that every instruction is valid, every jump lands inside the
+// bytecode, the stack never drops below the frame base, the stack depth is the same on
+// every path reaching an instruction, and every path ends in a return or a throw. It
+// also checks that exception handlers are well formed, that their recorded stack heights
+// match the code, and that declared types match the argument and result counts. It
+// returns an error wrapping ErrInvalidProgram if any of these checks fail.
+//
+// Prototypes are checked once when created by NewFuncProto, Assemble or UnmarshalBinary,
+// so verifying them again is free. Verify never modifies the prototype, so it can be
+// called concurrently by the virtual machines sharing it.
+func Verify(proto *FuncProto) error {
+	if proto.verified {
+		return nil
+	}
+	_, err := verify(proto)
+	return err
+}
+
+// verify checks a prototype like Verify, without recording the result, and returns its
+// analysis.
+func verify(proto *FuncProto) (*verifier, error) {
+	if err := verifyNested(proto); err != nil {
+		return nil, err
+	}
+	v, err := analyze(proto)
+	if err != nil {
+		return nil, err
+	}
+	for i, h := range proto.handlers {
+		if h.height != v.heights[i] {
+			return nil, fmt.Errorf("%w: handler %d expects stack height %d, got %d",
+				ErrInvalidProgram, i, v.heights[i], h.height)
+		}
+	}
+	return v, nil
+}
+
+// verifyNested verifies the prototypes nested in the constant pool of a prototype.
+func verifyNested(proto *FuncProto) error {
+	for _, k := range proto.constPool {
+		if fn, ok := k.v.(*Function); ok {
+			if err := Verify(fn.proto); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+type verifier struct {
+	proto    *FuncProto
+	depths   []int // stack depth before each instruction, -1 if not reached yet
+	heights  []int // stack height of each handler, -1 if its region is not reached yet
+	work     []InstPtr
+	maxDepth int
+}
+
+// analyze performs the data flow analysis of the bytecode of a prototype, without
+// verifying its nested prototypes.
+func analyze(proto *FuncProto) (*verifier, error) {
+	v := &verifier{
+		proto:    proto,
+		depths:   make([]int, len(proto.bytecode)),
+		heights:  make([]int, len(proto.handlers)),
+		maxDepth: proto.nargs + proto.nlocals,
+	}
+	if proto.paramTypes != nil && len(proto.paramTypes) != proto.nargs {
+		return nil, fmt.Errorf("%w: %d parameter types for %d arguments", ErrInvalidProgram, len(proto.paramTypes), proto.nargs)
+	}
+	if proto.resultTypes != nil && (!proto.hasResults || len(proto.resultTypes) != proto.nresults) {
+		return nil, fmt.Errorf("%w: %d result types for %d results", ErrInvalidProgram, len(proto.resultTypes), proto.nresults)
+	}
+	for i := range v.depths {
+		v.depths[i] = -1
+	}
+	for i, h := range proto.handlers {
+		if h.start >= h.end || int(h.end) > len(proto.bytecode) || int(h.target) >= len(proto.bytecode) {
+			return nil, fmt.Errorf("%w: handler %d out of range", ErrInvalidProgram, i)
+		}
+		v.heights[i] = -1
+	}
+	if err := v.flow(0, 0, proto.nargs+proto.nlocals); err != nil {
+		return nil, err
+	}
+	for {
+		for len(v.work) > 0 {
+			ip := v.work[len(v.work)-1]
+			v.work = v.work[:len(v.work)-1]
+			if err := v.inst(ip); err != nil {
+				return nil, err
+			}
+		}
+
+		// The stack height of a handler is the lowest stack depth of its region. Once
+		// the region is reached, the exception flows from there to the handler with the
+		// exception value on top. Handlers may reach other regions, so repeat until no
+		// more handlers are reached.
+		var reached []int
+		for i, h := range proto.handlers {
+			if v.heights[i] < 0 && v.regionHeight(h) >= 0 {
+				reached = append(reached, i)
+			}
+		}
+		if len(reached) == 0 {
+			break
+		}
+		for _, i := range reached {
+			h := proto.handlers[i]
+			v.heights[i] = v.regionHeight(h)
+			if err := v.flow(h.start, h.target, v.heights[i]+1); err != nil {
+				return nil, err
+			}
+			v.maxDepth = max(v.maxDepth, v.heights[i]+1)
+		}
+	}
+	for i, h := range proto.handlers {
+		if v.heights[i] < 0 {
+			v.heights[i] = 0 // unreachable region
+		} else if height := v.regionHeight(h); height != v.heights[i] {
+			return nil, fmt.Errorf("%w: handler %d: inconsistent stack height: %d and %d",
+				ErrInvalidProgram, i, v.heights[i], height)
+		}
+	}
+	return v, nil
+}
+
+func (v *verifier) errorf(ip InstPtr, format string, args ...any) error {
+	msg := fmt.Sprintf(format, args...)
+	if int(ip) < len(v.proto.bytecode) {
+		return fmt.Errorf("%w: %04d %s: %s", ErrInvalidProgram, ip, v.proto.bytecode[ip], msg)
+	}
+	return fmt.Errorf("%w: %s", ErrInvalidProgram, msg)
+}
+
+// flow records that the instruction at ip is reached from the instruction at from with
+// the given stack depth.
+func (v *verifier) flow(from, ip InstPtr, depth int) error {
+	if int(ip) >= len(v.proto.bytecode) {
+		return v.errorf(from, "execution reaches the end of the function without return")
+	}
+	switch v.depths[ip] {
+	case -1:
+		v.depths[ip] = depth
+		v.work = append(v.work, ip)
+	case depth:
+	default:
+		return v.errorf(ip, "inconsistent stack depth: %d and %d", v.depths[ip], depth)
+	}
+	return nil
+}
+
+func (v *verifier) inst(ip InstPtr) error {
+	inst := v.proto.bytecode[ip]
+	depth := v.depths[ip]
+	info, ok := opInfos[inst.opCode()]
+	if !ok {
+		return v.errorf(ip, "invalid opcode 0x%04X", uint16(inst.opCode()))
+	}
+
+	pops, pushes := info.pops, info.pushes
+	arg := int(inst.argInt())
+	switch inst.opCode() {
+	case opRet:
+		if arg < 0 || arg > depth {
+			return v.errorf(ip, "returns %d values with stack depth %d", arg, depth)
+		}
+		if v.proto.hasResults && arg != v.proto.nresults {
+			return v.errorf(ip, "returns %d values, declares %d results", arg, v.proto.nresults)
+		}
+		return nil
+	case opRetv:
+		if arg < 0 || arg > depth {
+			return v.errorf(ip, "slot %d out of stack depth %d", arg, depth)
+		}
+		// The stack depth is known, and so is the number of values returned.
+		if v.proto.hasResults && depth-arg != v.proto.nresults {
+			return v.errorf(ip, "returns %d values, declares %d results", depth-arg, v.proto.nresults)
+		}
+		return nil
+	case opThrow:
+		if depth < 1 {
+			return v.errorf(ip, "stack underflow: pops 1 values with stack depth %d", depth)
+		}
+		return nil
+	case opCall, opResume:
+		if arg < 0 || arg > math.MaxUint16 {
+			return v.errorf(ip, "argument count %d out of range", arg)
+		}
+		pops, pushes = 1+arg, int(inst.argB())
+	case opYield:
+		if arg < 0 || arg > math.MaxUint16 {
+			return v.errorf(ip, "value count %d out of range", arg)
+		}
+		pops, pushes = arg, int(inst.argB())
+	case opDup:
+		if arg < 0 || arg >= depth {
+			return v.errorf(ip, "slot %d out of stack depth %d", arg, depth)
+		}
+	case opPop:
+		if arg < 0 || arg >= depth-1 {
+			return v.errorf(ip, "slot %d out of stack depth %d", arg, depth-1)
+		}
+	case opLoad:
+		if arg < 0 || arg >= v.proto.nargs+v.proto.nlocals || arg >= depth {
+			return v.errorf(ip, "variable slot %d out of range", arg)
+		}
+	case opStore:
+		if arg < 0 || arg >= v.proto.nargs+v.proto.nlocals || arg >= depth-1 {
+			return v.errorf(ip, "variable slot %d out of range", arg)
+		}
+	case opVararg, opVarargn:
+		if !v.proto.variadic {
+			return v.errorf(ip, "function is not variadic")
+		}
+	case opPushk:
+		if arg < 0 || arg >= len(v.proto.constPool) {
+			return v.errorf(ip, "constant %d out of range", arg)
+		}
+	case opClosure:
+		if err := v.closure(ip, arg, depth); err != nil {
+			return err
+		}
+	case opGetUpval, opSetUpval:
+		if arg < 0 || arg >= len(v.proto.upvals) {
+			return v.errorf(ip, "upvalue %d out of range", arg)
+		}
+	case opGetGlobal, opSetGlobal:
+		if arg < 0 || arg >= len(v.proto.constPool) {
+			return v.errorf(ip, "constant %d out of range", arg)
+		}
+		if v.proto.constPool[arg].t != TypeString {
+			return v.errorf(ip, "constant %d is not a string", arg)
+		}
+	}
+
+	if depth < pops {
+		return v.errorf(ip, "stack underflow: pops %d values with stack depth %d", pops, depth)
+	}
+	depth += pushes - pops
+	v.maxDepth = max(v.maxDepth, depth)
+
+	switch inst.opCode() {
+	case opJmp:
+		return v.jump(ip, InstPtr(arg), depth)
+	case opBr:
+		if err := v.jump(ip, InstPtr(arg), depth); err != nil {
+			return err
+		}
+	}
+	return v.flow(ip, ip+1, depth)
+}
+
+// regionHeight returns the lowest stack depth of the region of a handler, or -1 if the
+// region is not reached.
+func (v *verifier) regionHeight(h handler) int {
+	height := -1
+	for _, depth := range v.depths[h.start:h.end] {
+		if depth >= 0 && (height < 0 || depth < height) {
+			height = depth
+		}
+	}
+	return height
+}
+
+func (v *verifier) jump(from, to InstPtr, depth int) error {
+	if int(to) >= len(v.proto.bytecode) {
+		return v.errorf(from, "jump target %d out of range", to)
+	}
+	return v.flow(from, to, depth)
+}
+
+func (v *verifier) closure(ip InstPtr, k, depth int) error {
+	if k < 0 || k >= len(v.proto.constPool) {
+		return v.errorf(ip, "constant %d out of range", k)
+	}
+	fn, ok := v.proto.constPool[k].v.(*Function)
+	if !ok {
+		return v.errorf(ip, "constant %d is not a function", k)
+	}
+	for _, uv := range fn.proto.upvals {
+		if uv.local && (uv.index < 0 || uv.index >= depth) {
+			return v.errorf(ip, "captured slot %d out of stack depth %d", uv.index, depth)
+		}
+		if !uv.local && (uv.index < 0 || uv.index >= len(v.proto.upvals)) {
+			return v.errorf(ip, "captured upvalue %d out of range", uv.index)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+package stackvm
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerify(t *testing.T) {
+	proto, err := Assemble(strings.NewReader(`
+.func inc 1
+.upval local 0
+	DUP 0
+	GETUPVAL 0
+	ADDI
+	RET 1
+.end
+
+.func main 1
+	CLOSURE inc
+loop:
+	DUP 0
+	PUSHI 10
+	GEI
+	BR end
+	DUP 0
+	DUP 1
+	CALL 1, 1
+	POP 0
+	JMP loop
+end:
+	DUP 0
+	RET 1
+.end
+`))
+	require.NoError(t, err)
+	require.NoError(t, Verify(proto))
+	assert.True(t, proto.verified)
+	assert.Equal(t, 4, proto.maxStack)
+	assert.Equal(t, 3, proto.constPool[0].v.(*Function).proto.maxStack)
+}
+
+func TestVerify_Invalid(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		code     []Inst
+		nargs    int
+		consts   []Value
+		decl     bool // declares zero results
+		handlers []handler
+		msg      string
+	}{
+		{
+			name: "empty",
+			msg:  "end of the function without return",
+		},
+		{
+			name: "invalid opcode",
+			code: []Inst{Inst(0xFFFF << 48)},
+			msg:  "invalid opcode 0xFFFF",
+		},
+		{
+			name: "jump out of range",
+			code: []Inst{JMP(3), RET(0)},
+			msg:  "jump target 3 out of range",
+		},
+		{
+			name: "underflow",
+			code: []Inst{PUSHI(1), ADDI(), RET(1)},
+			msg:  "stack underflow",
+		},
+		{
+			name: "inconsistent depth",
+			code: []Inst{
+				PUSHI(1),
+				BR(4),
+				PUSHI(2),
+				PUSHI(3),
+				RET(0),
+			},
+			nargs: 1,
+			msg:   "inconsistent stack depth",
+		},
+		{
+			name: "missing return",
+			code: []Inst{PUSHI(1), NOP()},
+			msg:  "end of the function without return",
+		},
+		{
+			name:  "return too many values",
+			code:  []Inst{RET(2)},
+			nargs: 1,
+			msg:   "returns 2 values with stack depth 1",
+		},
+		{
+			name:  "dup out of frame",
+			code:  []Inst{DUP(1), RET(1)},
+			nargs: 1,
+			msg:   "slot 1 out of stack depth 1",
+		},
+		{
+			name: "constant out of range",
+			code: []Inst{PUSHK(0), RET(1)},
+			msg:  "constant 0 out of range",
+		},
+		{
+			name: "upvalue out of range",
+			code: []Inst{GETUPVAL(0), RET(1)},
+			msg:  "upvalue 0 out of range",
+		},
+		{
+			name:  "return count not declared",
+			code:  []Inst{RET(1)},
+			nargs: 1,
+			decl:  true,
+			msg:   "returns 1 values, declares 0 results",
+		},
+		{
+			name:  "variable return count not declared",
+			code:  []Inst{PUSHI(1), RETV(0)},
+			nargs: 1,
+			decl:  true,
+			msg:   "returns 2 values, declares 0 results",
+		},
+		{
+			name:  "variable slot out of range",
+			code:  []Inst{PUSHI(1), STORE(1), RET(0)},
+			nargs: 1,
+			msg:   "variable slot 1 out of range",
+		},
+		{
+			name:   "global name not a string",
+			code:   []Inst{GETGLOBAL(0), RET(1)},
+			consts: []Value{NewInt(1)},
+			msg:    "constant 0 is not a string",
+		},
+		{
+			name:  "call count out of range",
+			code:  []Inst{CALL(0, 0).withOpInt(0x10001), RET(0)},
+			nargs: 1,
+			msg:   "argument count 65537 out of range",
+		},
+		{
+			name:  "yield count out of range",
+			code:  []Inst{YIELD(0, 0).withOpInt(-1), RET(0)},
+			nargs: 1,
+			msg:   "value count -1 out of range",
+		},
+		{
+			name: "vararg in fixed function",
+			code: []Inst{VARARGN(), RET(1)},
+			msg:  "function is not variadic",
+		},
+		{
+			name:     "handler out of range",
+			code:     []Inst{RET(0)},
+			handlers: []handler{{start: 0, end: 1, target: 1}},
+			msg:      "handler 0 out of range",
+		},
+		{
+			name:     "handler height mismatch",
+			code:     []Inst{NOP(), RET(0), RET(0)},
+			handlers: []handler{{start: 0, end: 1, target: 2, height: 1}},
+			msg:      "handler 0 expects stack height 0, got 1",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			err := Verify(&FuncProto{
+				nargs:      test.nargs,
+				hasResults: test.decl,
+				bytecode:   test.code,
+				constPool:  test.consts,
+				handlers:   test.handlers,
+			})
+			require.ErrorIs(t, err, ErrInvalidProgram)
+			assert.Contains(t, err.Error(), test.msg)
+		})
+	}
+}
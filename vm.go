@@ -1,10 +1,67 @@
 package stackvm
 
-import "fmt"
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Status is the execution status of a virtual machine.
+type Status uint8
+
+const (
+	// StatusIdle is the status of a virtual machine that has not started any run yet.
+	StatusIdle Status = iota
+
+	// StatusRunning is the status of a virtual machine with a run in progress, either
+	// executing or paused between steps.
+	StatusRunning
+
+	// StatusSuspended is the status of a virtual machine whose run was suspended by a
+	// host function, waiting for the results of the host function to be given to Resume.
+	StatusSuspended
+
+	// StatusDone is the status of a virtual machine whose last run returned.
+	StatusDone
+
+	// StatusFaulted is the status of a virtual machine whose last run failed.
+	StatusFaulted
+)
+
+var statusNames = map[Status]string{
+	StatusIdle:      "idle",
+	StatusRunning:   "running",
+	StatusSuspended: "suspended",
+	StatusDone:      "done",
+	StatusFaulted:   "faulted",
+}
+
+func (s Status) String() string {
+	return statusNames[s]
+}
 
 // VirtualMachine is the main struct that represents the virtual machine.
 type VirtualMachine struct {
-	stack *stack
+	stack       *stack     // the stack being executed
+	co          *Coroutine // the coroutine being executed, nil for the main stack
+	yielded     *[]Value   // values yielded to the host by the coroutine being executed
+	stackLimit  int
+	stackSize   int
+	callDepth   int
+	verify      bool
+	budget      uint64
+	used        uint64
+	costs       map[opCode]uint64
+	intMode     IntegerMode
+	floatPolicy FloatPolicy
+	globals     map[string]global
+
+	status     Status
+	results    []Value // the results of the last run, if done
+	busy       bool    // whether an instruction is being executed
+	nested     int     // the number of coroutines being resumed from the host
+	suspending bool    // whether the host function being called asked to suspend the run
+	pending    int     // the number of results expected by the host function that suspended the run
 }
 
 // New creates a new virtual machine.
@@ -14,35 +71,537 @@ func New(opts ...Option) *VirtualMachine {
 	for _, opt := range opts {
 		opt(&s)
 	}
-	return &VirtualMachine{
-		stack: newStack(s.stackLimit),
+	costs := make(map[opCode]uint64, len(s.costs))
+	for mnemonic, cost := range s.costs {
+		if op, ok := opCodes[mnemonic]; ok {
+			costs[op] = cost
+		}
+	}
+	vm := &VirtualMachine{
+		stackLimit:  s.stackLimit,
+		stackSize:   s.stackSize,
+		callDepth:   s.callDepth,
+		verify:      s.verify,
+		budget:      s.budget,
+		costs:       costs,
+		intMode:     s.intMode,
+		floatPolicy: s.floatPolicy,
+	}
+	vm.stack = vm.newStack()
+	return vm
+}
+
+// newStack creates a new stack with the settings of the virtual machine.
+func (vm *VirtualMachine) newStack() *stack {
+	s := newStack(vm.stackLimit)
+	s.maxFrames = vm.callDepth
+	s.data = make([]Value, 0, max(min(vm.stackSize, vm.stackLimit), 0))
+	return s
+}
+
+// BudgetUsed returns the budget consumed by the last run.
+func (vm *VirtualMachine) BudgetUsed() uint64 {
+	return vm.used
+}
+
+// Status returns the execution status of the virtual machine.
+func (vm *VirtualMachine) Status() Status {
+	return vm.status
+}
+
+// Results returns the values returned by the last run, if it is done.
+func (vm *VirtualMachine) Results() []Value {
+	return vm.results
+}
+
+// Location returns the function, address and source position of the next instruction to
+// be executed, or a zero entry if there is none.
+func (vm *VirtualMachine) Location() TraceEntry {
+	frame := vm.stack.currentFrame()
+	if frame == nil {
+		return TraceEntry{}
+	}
+	return TraceEntry{
+		Function: frame.proto.name,
+		IP:       frame.ip,
+		Pos:      frame.proto.position(frame.ip),
 	}
 }
 
-// Run runs the virtual machine with a given function prototype.
+// ctxCheckInterval is the number of instructions executed between context checks, in
+// addition to the checks performed on backward jumps and calls.
+const ctxCheckInterval = 1024
+
+// Run runs the virtual machine with a given function prototype. Malformed bytecode makes
+// the run fail instead of panicking, and so does a panicking host function: the panic is
+// recovered and reported as ErrInternal.
 func (vm *VirtualMachine) Run(proto *FuncProto, args ...Value) ([]Value, error) {
-	if frame := vm.stack.currentFrame(); frame != nil {
-		return nil, fmt.Errorf("%w: VM is already running", ErrIllegalState)
+	return vm.RunContext(context.Background(), proto, args...)
+}
+
+// RunContext runs the virtual machine with a given function prototype until it returns
+// or the context is done. In the latter case, it fails with ErrInterrupted wrapping the
+// context error.
+func (vm *VirtualMachine) RunContext(ctx context.Context, proto *FuncProto, args ...Value) ([]Value, error) {
+	if err := vm.Start(proto, args...); err != nil {
+		return nil, err
+	}
+	return vm.RunUntil(ctx, nil)
+}
+
+// Start starts a new run of the given function prototype without executing any
+// instruction. The run is then driven by Step or RunUntil. It fails with ErrIllegalState
+// if another run is in progress, which can be discarded with Reset.
+func (vm *VirtualMachine) Start(proto *FuncProto, args ...Value) error {
+	if vm.busy || vm.status == StatusRunning || vm.status == StatusSuspended || vm.stack.currentFrame() != nil {
+		return fmt.Errorf("%w: VM is already running", ErrIllegalState)
+	}
+	if proto == nil {
+		return fmt.Errorf("%w: no function prototype", ErrInvalidProgram)
 	}
+	if vm.verify {
+		if err := Verify(proto); err != nil {
+			return err
+		}
+	}
+	vm.used = 0
+	vm.results = nil
 	for _, arg := range args {
-		vm.stack.push(arg)
+		if err := vm.stack.push(arg); err != nil {
+			vm.stack.popAll()
+			return err
+		}
+	}
+	if _, err := vm.stack.newFrame(proto, len(args)); err != nil {
+		vm.stack.popAll()
+		return err
 	}
-	vm.stack.newFrame(proto)
+	vm.status = StatusRunning
+	return nil
+}
+
+// Step executes the next instruction of the current run. When the run returns, the status
+// turns to done and the returned values are available from Results. If the instruction
+// fails, the status turns to faulted and the error is returned. If it suspends the run,
+// ErrSuspended is returned.
+func (vm *VirtualMachine) Step() error {
+	if err := vm.ensureRunning(); err != nil {
+		return err
+	}
+	_, _, err := vm.step(context.Background(), nil, false)
+	return err
+}
+
+// RunUntil executes the current run until the given predicate holds before the next
+// instruction, the run returns, it is suspended or the context is done. A nil predicate
+// never holds. It returns the returned values if the run is done, or no values if it is
+// stopped by the predicate.
+func (vm *VirtualMachine) RunUntil(ctx context.Context, pred func(vm *VirtualMachine) bool) ([]Value, error) {
+	if err := vm.ensureRunning(); err != nil {
+		return nil, err
+	}
+	for steps := 1; pred == nil || !pred(vm); steps++ {
+		values, done, err := vm.step(ctx, nil, steps%ctxCheckInterval == 0)
+		if err != nil || done {
+			return values, err
+		}
+	}
+	return nil, nil
+}
+
+// Suspend asks the virtual machine to suspend the current run once the host function
+// being called returns. The results returned by the host function are discarded, and
+// must be given to Resume instead. It fails with ErrIllegalState if the run cannot be
+// suspended, e.g. when the host function is called from a coroutine resumed by the host.
+func (vm *VirtualMachine) Suspend() error {
+	if vm.status != StatusRunning || !vm.busy || vm.nested > 0 {
+		return fmt.Errorf("%w: cannot suspend", ErrIllegalState)
+	}
+	vm.suspending = true
+	return nil
+}
+
+// Resume gives the results of the host function that suspended the current run, so it
+// can be continued by Step or RunUntil.
+func (vm *VirtualMachine) Resume(results ...Value) error {
+	if vm.busy || vm.status != StatusSuspended {
+		return fmt.Errorf("%w: VM is not suspended", ErrIllegalState)
+	}
+	if len(results) != vm.pending {
+		return fmt.Errorf("%w: expected %d results, got %d", ErrArityMismatch, vm.pending, len(results))
+	}
+	for _, result := range results {
+		if err := vm.stack.push(result); err != nil {
+			return err
+		}
+	}
+	vm.status = StatusRunning
+	return nil
+}
 
-	for {
-		frame := vm.stack.currentFrame()
-		if frame == nil {
-			// Call stack unwind. Return the values on the stack.
-			values := vm.stack.popAll()
-			return values, nil
+// Reset discards the current run, if any, and turns the virtual machine back to idle. The
+// global variables are kept, so a virtual machine can be reused across unrelated runs.
+// It fails with ErrIllegalState if called while an instruction is being executed, e.g.
+// from a host function.
+func (vm *VirtualMachine) Reset() error {
+	if vm.busy {
+		return fmt.Errorf("%w: VM is busy", ErrIllegalState)
+	}
+	vm.abort(nil)
+	vm.stack.reset()
+	vm.yielded = nil
+	vm.status = StatusIdle
+	vm.results = nil
+	vm.used = 0
+	vm.suspending = false
+	vm.pending = 0
+	return nil
+}
+
+func (vm *VirtualMachine) ensureRunning() error {
+	switch {
+	case vm.busy:
+		return fmt.Errorf("%w: VM is busy", ErrIllegalState)
+	case vm.status == StatusSuspended:
+		return fmt.Errorf("%w: VM is suspended", ErrSuspended)
+	case vm.status != StatusRunning:
+		return fmt.Errorf("%w: VM is not running", ErrIllegalState)
+	}
+	return nil
+}
+
+// exec executes instructions until the frames of the current stack are unwound, or until
+// the coroutine being executed yields to the host. It returns the values left on the stack
+// or yielded to the host, respectively.
+func (vm *VirtualMachine) exec(ctx context.Context) ([]Value, error) {
+	base := vm.co
+	for steps := 1; ; steps++ {
+		values, done, err := vm.step(ctx, base, steps%ctxCheckInterval == 0)
+		if err != nil || done {
+			return values, err
+		}
+	}
+}
+
+// step executes the next instruction of the execution that entered the base coroutine,
+// or the main stack if nil. It returns true along with the values left on the stack or
+// yielded to the host when the execution is done. The context is checked if requested or
+// if the instruction is a checkpoint.
+func (vm *VirtualMachine) step(ctx context.Context, base *Coroutine, check bool) ([]Value, bool, error) {
+	frame := vm.stack.currentFrame()
+	inst, ok := frame.nextInst()
+	if !ok {
+		return nil, true, vm.fail(base, fmt.Errorf("%w: program ended without return", ErrInvalidProgram))
+	}
+	ip := frame.ip
+	if err := vm.charge(inst); err != nil {
+		return nil, true, vm.fail(base, vm.runtimeError(err, inst, ip))
+	}
+	if done := ctx.Done(); done != nil && (check || isCheckpoint(inst, ip)) {
+		select {
+		case <-done:
+			err := fmt.Errorf("%w: %w", ErrInterrupted, ctx.Err())
+			return nil, true, vm.fail(base, vm.runtimeError(err, inst, ip))
+		default:
 		}
-		inst, ok := frame.nextInst()
-		if !ok {
-			return nil, fmt.Errorf("%w: program ended without return", ErrInvalidProgram)
+	}
+	frame.incIP()
+	busy := vm.busy // instructions may be nested by host functions resuming coroutines
+	vm.busy = true
+	err := vm.execute(inst)
+	vm.busy = busy
+	if err != nil {
+		rerr := vm.runtimeError(err, inst, ip)
+		if isFault(err) || !vm.catch(exceptionValue(err)) {
+			return nil, true, vm.fail(base, rerr)
 		}
-		frame.incIP()
-		if err := inst.execute(vm); err != nil {
-			return nil, err
+	}
+	if vm.yielded != nil {
+		values := *vm.yielded
+		vm.yielded = nil
+		return values, true, nil
+	}
+	if vm.status == StatusSuspended && base == nil {
+		return nil, true, ErrSuspended
+	}
+	for vm.stack.currentFrame() == nil {
+		// Call stack unwind. Return the values on the stack.
+		values := vm.stack.popAll()
+		if vm.co == base {
+			if base != nil {
+				base.status = CoroutineDead
+			} else {
+				vm.status = StatusDone
+				vm.results = values
+			}
+			return values, true, nil
 		}
+		// A coroutine resumed from the bytecode returned.
+		vm.co.status = CoroutineDead
+		if err := vm.leaveCoroutine(values); err != nil {
+			return nil, true, vm.fail(base, err)
+		}
+	}
+	return nil, false, nil
+}
+
+// execute executes an instruction, recovering from any panic raised by it as an internal
+// fault. Internal faults cannot be caught by exception handlers, since the instruction may
+// have been executed partially.
+func (vm *VirtualMachine) execute(inst Inst) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%w: %v", ErrInternal, r)
+		}
+	}()
+	return inst.execute(vm)
+}
+
+// fail aborts the execution that entered the base coroutine, faulting the run if it is
+// executed by the main stack, and returns the given error. A faulted run is unwound, so
+// the virtual machine can start a new one.
+func (vm *VirtualMachine) fail(base *Coroutine, err error) error {
+	vm.abort(base)
+	if base == nil {
+		vm.stack.reset()
+		vm.status = StatusFaulted
+	}
+	return err
+}
+
+// abort kills the coroutines resumed from the bytecode since the execution entered the
+// base coroutine, along with the base coroutine itself, and switches back to the stack
+// the execution started from.
+func (vm *VirtualMachine) abort(base *Coroutine) {
+	for co := vm.co; co != base; co = co.callerCo {
+		co.status = CoroutineDead
+		vm.stack = co.caller
+	}
+	vm.co = base
+	if base != nil {
+		base.status = CoroutineDead
+	}
+}
+
+// runtimeError wraps an error raised by the instruction at the given address of the
+// current frame, along with the traceback of the active frames.
+func (vm *VirtualMachine) runtimeError(err error, inst Inst, ip InstPtr) *RuntimeError {
+	trace := make([]TraceEntry, 0, len(vm.stack.frames))
+	for i := len(vm.stack.frames) - 1; i >= 0; i-- {
+		frame := &vm.stack.frames[i]
+		at := frame.ip - 1 // callers are executing the instruction before their next one
+		if i == len(vm.stack.frames)-1 {
+			at = ip
+		}
+		trace = append(trace, TraceEntry{
+			Function: frame.proto.name,
+			IP:       at,
+			Pos:      frame.proto.position(at),
+		})
+	}
+	return &RuntimeError{Err: err, Inst: inst, IP: ip, Trace: trace}
+}
+
+// exceptionValue returns the value of the exception raised by an error.
+func exceptionValue(err error) Value {
+	var exc *Exception
+	if errors.As(err, &exc) {
+		return exc.Value
+	}
+	return NewError(err)
+}
+
+// isFault reports whether an error raised by an instruction is an internal fault, which
+// cannot be caught. Any value thrown by THROW can be caught, even a rethrown fault.
+func isFault(err error) bool {
+	var exc *Exception
+	return errors.Is(err, ErrInternal) && !errors.As(err, &exc)
+}
+
+// catch unwinds the stack to the innermost handler covering the instruction being executed
+// by each frame, and pushes the exception value for the handler. If the current stack
+// belongs to a coroutine resumed from the bytecode, the coroutine dies and its resumer is
+// unwound next. It returns false if no handler is found.
+func (vm *VirtualMachine) catch(exc Value) bool {
+	for !vm.catchFrame(exc) {
+		co := vm.co
+		if co == nil || co.caller == nil {
+			return false
+		}
+		co.status = CoroutineDead
+		vm.stack, vm.co = co.caller, co.callerCo
+	}
+	return true
+}
+
+func (vm *VirtualMachine) catchFrame(exc Value) bool {
+	for i := len(vm.stack.frames) - 1; i >= 0; i-- {
+		frame := &vm.stack.frames[i]
+		at := frame.ip - 1
+		for _, h := range frame.proto.handlers {
+			if at < h.start || at >= h.end {
+				continue
+			}
+			level := frame.stackBase + h.height
+			if level > len(vm.stack.data) {
+				return false
+			}
+			vm.stack.frames = vm.stack.frames[:i+1]
+			vm.stack.closeUpvalues(level)
+			vm.stack.data = vm.stack.data[:level]
+			frame.ip = h.target
+			return vm.stack.push(exc) == nil
+		}
+	}
+	return false
+}
+
+// isCheckpoint returns whether the instruction at the given address is a backward jump or
+// a call, where the context of the run must be checked.
+func isCheckpoint(inst Inst, ip InstPtr) bool {
+	switch inst.opCode() {
+	case opJmp, opBr:
+		return InstPtr(inst.argInt()) <= ip
+	case opCall, opResume:
+		return true
+	default:
+		return false
+	}
+}
+
+func (vm *VirtualMachine) charge(inst Inst) error {
+	cost, ok := vm.costs[inst.opCode()]
+	if !ok {
+		cost = 1
+	}
+	if vm.budget > 0 && (vm.used > vm.budget || cost > vm.budget-vm.used) {
+		return fmt.Errorf("%w: %d of %d units used", ErrBudgetExceeded, vm.used, vm.budget)
+	}
+	vm.used += cost
+	return nil
+}
+
+func (vm *VirtualMachine) call(nargs, nres int) error {
+	callee, err := vm.stack.pop()
+	if err != nil {
+		return err
+	}
+	switch callee.t {
+	case TypeFunction:
+		return vm.callFunction(callee.v.(*Function), nargs, nres)
+	case TypeHostFunction:
+		return vm.callHost(callee.v.(*HostFunction), nargs, nres)
+	default:
+		return fmt.Errorf("%w: expected function, got %s", ErrTypeMismatch, typeNames[callee.t])
+	}
+}
+
+func (vm *VirtualMachine) callFunction(fn *Function, nargs, nres int) error {
+	if fn.proto.hasResults && nres != fn.proto.nresults {
+		return fmt.Errorf("%w: function declares %d results, %d expected", ErrArityMismatch, fn.proto.nresults, nres)
+	}
+	if vm.verify {
+		if err := Verify(fn.proto); err != nil {
+			return err
+		}
+	}
+	frame, err := vm.stack.newFrame(fn.proto, nargs)
+	if err != nil {
+		return err
+	}
+	frame.nres = nres
+	frame.upvals = fn.upvals
+	return nil
+}
+
+func (vm *VirtualMachine) callHost(fn *HostFunction, nargs, nres int) error {
+	args, err := vm.stack.popN(nargs)
+	if err != nil {
+		return err
+	}
+	results, err := fn.fn(vm, args)
+	suspending := vm.suspending
+	vm.suspending = false
+	if err != nil {
+		return fmt.Errorf("host function %s: %w", fn.name, err)
+	}
+	if suspending {
+		vm.status = StatusSuspended
+		vm.pending = nres
+		return nil
+	}
+	if len(results) != nres {
+		return fmt.Errorf("%w: expected %d results, got %d", ErrArityMismatch, nres, len(results))
+	}
+	for _, result := range results {
+		if err := vm.stack.push(result); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (vm *VirtualMachine) closure(idx int) error {
+	k, err := vm.constant(idx)
+	if err != nil {
+		return err
+	}
+	if err := k.ensureType(TypeFunction); err != nil {
+		return err
+	}
+	frame := vm.stack.currentFrame()
+	proto := k.v.(*Function).proto
+	fn := &Function{proto: proto, upvals: make([]*upvalue, len(proto.upvals))}
+	for i, desc := range proto.upvals {
+		if !desc.local {
+			if desc.index < 0 || desc.index >= len(frame.upvals) {
+				return fmt.Errorf("%w: upvalue %d out of range", ErrInvalidProgram, desc.index)
+			}
+			fn.upvals[i] = frame.upvals[desc.index]
+			continue
+		}
+		slot := frame.stackBase + desc.index
+		if desc.index < 0 {
+			return ErrStackUnderflow
+		}
+		if slot >= len(vm.stack.data) {
+			return ErrStackOverflow
+		}
+		fn.upvals[i] = vm.stack.capture(slot)
+	}
+	return vm.stack.push(newValue(TypeFunction, fn))
+}
+
+func (vm *VirtualMachine) upvalue(idx int) (*upvalue, error) {
+	frame := vm.stack.currentFrame()
+	if idx < 0 || idx >= len(frame.upvals) {
+		return nil, fmt.Errorf("%w: upvalue %d out of range", ErrInvalidProgram, idx)
+	}
+	return frame.upvals[idx], nil
+}
+
+// vararg returns the extra argument of the current frame at the given index.
+func (vm *VirtualMachine) vararg(idx int32) (Value, error) {
+	varargs := vm.stack.currentFrame().varargs
+	if idx < 0 || int(idx) >= len(varargs) {
+		return NoValue, fmt.Errorf("%w: vararg %d out of range, %d given", ErrArityMismatch, idx, len(varargs))
+	}
+	return varargs[idx], nil
+}
+
+// variable checks that a slot is an argument or a local of the current frame.
+func (vm *VirtualMachine) variable(slot int) (int, error) {
+	proto := vm.stack.currentFrame().proto
+	if slot < 0 || slot >= proto.nargs+proto.nlocals {
+		return 0, fmt.Errorf("%w: variable slot %d out of range", ErrInvalidProgram, slot)
+	}
+	return slot, nil
+}
+
+func (vm *VirtualMachine) constant(idx int) (Value, error) {
+	pool := vm.stack.currentFrame().proto.constPool
+	if idx < 0 || idx >= len(pool) {
+		return NoValue, fmt.Errorf("%w: constant %d out of range", ErrInvalidProgram, idx)
 	}
+	return pool[idx], nil
 }
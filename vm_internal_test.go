@@ -0,0 +1,22 @@
+package stackvm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVM_ChargeOverBudget(t *testing.T) {
+	forever, err := NewFuncProto(0, func(b *FuncProtoBuilder) {
+		b.Emit(JMP(0))
+	})
+	require.NoError(t, err)
+
+	vm := New(WithInstructionLimit(10))
+	require.NoError(t, vm.Start(forever))
+	vm.used = 20
+	err = vm.Step()
+	require.ErrorIs(t, err, ErrBudgetExceeded)
+	assert.Equal(t, uint64(20), vm.BudgetUsed())
+}
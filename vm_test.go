@@ -1,10 +1,19 @@
 package stackvm_test
 
 import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/apoloval/stackvm"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -154,6 +163,25 @@ func TestVM(t *testing.T) {
 				b.Emit(stackvm.RET(1))
 			},
 		},
+		{
+			name: "is_admin(name: string) -> bool",
+			samples: []funcSample{
+				{
+					args:     []stackvm.Value{stackvm.NewString("admin")},
+					expected: []stackvm.Value{stackvm.NewBool(true)},
+				},
+				{
+					args:     []stackvm.Value{stackvm.NewString("guest")},
+					expected: []stackvm.Value{stackvm.NewBool(false)},
+				},
+			},
+			code: func(b *stackvm.FuncProtoBuilder) {
+				b.Emit(stackvm.DUP(0))
+				b.Emit(stackvm.PUSHK(b.AddConst(stackvm.NewString("admin"))))
+				b.Emit(stackvm.EQS())
+				b.Emit(stackvm.RET(1))
+			},
+		},
 	} {
 		for i, sample := range test.samples {
 			t.Run(test.name+"[sample:"+strconv.Itoa(i)+"]", func(t *testing.T) {
@@ -171,7 +199,1322 @@ func TestVM(t *testing.T) {
 	}
 }
 
+func TestVM_Call(t *testing.T) {
+	square, err := stackvm.NewFuncProto(1, func(b *stackvm.FuncProtoBuilder) {
+		b.Emit(stackvm.DUP(0))
+		b.Emit(stackvm.DUP(0))
+		b.Emit(stackvm.MULI())
+		b.Emit(stackvm.RET(1))
+	})
+	require.NoError(t, err)
+
+	// main(x:int, f:func) -> int { return f(x) + 1 }
+	main, err := stackvm.NewFuncProto(2, func(b *stackvm.FuncProtoBuilder) {
+		b.Emit(stackvm.DUP(0))
+		b.Emit(stackvm.DUP(1))
+		b.Emit(stackvm.CALL(1, 1))
+		b.Emit(stackvm.PUSHI(1))
+		b.Emit(stackvm.ADDI())
+		b.Emit(stackvm.RET(1))
+	})
+	require.NoError(t, err)
+
+	vm := stackvm.New()
+	values, err := vm.Run(main, stackvm.NewInt(-7), stackvm.NewFunction(vm, square))
+	require.NoError(t, err)
+	require.Equal(t, []stackvm.Value{stackvm.NewInt(50)}, values)
+}
+
+func TestVM_CallArityMismatch(t *testing.T) {
+	square, err := stackvm.NewFuncProto(1, func(b *stackvm.FuncProtoBuilder) {
+		b.Emit(stackvm.DUP(0))
+		b.Emit(stackvm.DUP(0))
+		b.Emit(stackvm.MULI())
+		b.Emit(stackvm.RET(1))
+	})
+	require.NoError(t, err)
+
+	for _, test := range []struct {
+		name string
+		call stackvm.Inst
+	}{
+		{name: "arguments", call: stackvm.CALL(0, 1)},
+		{name: "results", call: stackvm.CALL(1, 2)},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			main, err := stackvm.NewFuncProto(1, func(b *stackvm.FuncProtoBuilder) {
+				b.Emit(stackvm.PUSHI(3))
+				b.Emit(stackvm.DUP(0))
+				b.Emit(test.call)
+				b.Emit(stackvm.RET(1))
+			})
+			require.NoError(t, err)
+
+			vm := stackvm.New()
+			_, err = vm.Run(main, stackvm.NewFunction(vm, square))
+			require.ErrorIs(t, err, stackvm.ErrArityMismatch)
+		})
+	}
+}
+
+func TestVM_CallHost(t *testing.T) {
+	errBoom := errors.New("boom")
+	divmod := stackvm.NewHostFunction("divmod", func(vm *stackvm.VirtualMachine, args []stackvm.Value) ([]stackvm.Value, error) {
+		a, _ := args[0].AsInt()
+		b, _ := args[1].AsInt()
+		if b == 0 {
+			return nil, errBoom
+		}
+		return []stackvm.Value{stackvm.NewInt(a / b), stackvm.NewInt(a % b)}, nil
+	})
+
+	// main(a, b:int, f:func) -> (int, int) { return f(a, b) }
+	main, err := stackvm.NewFuncProto(3, func(b *stackvm.FuncProtoBuilder) {
+		b.Emit(stackvm.DUP(0))
+		b.Emit(stackvm.DUP(1))
+		b.Emit(stackvm.DUP(2))
+		b.Emit(stackvm.CALL(2, 2))
+		b.Emit(stackvm.MULI())
+		b.Emit(stackvm.RET(1))
+	})
+	require.NoError(t, err)
+
+	vm := stackvm.New()
+	values, err := vm.Run(main, stackvm.NewInt(17), stackvm.NewInt(5), divmod)
+	require.NoError(t, err)
+	require.Equal(t, []stackvm.Value{stackvm.NewInt(6)}, values)
+
+	vm = stackvm.New()
+	_, err = vm.Run(main, stackvm.NewInt(17), stackvm.NewInt(0), divmod)
+	require.ErrorIs(t, err, errBoom)
+}
+
+func TestVM_Closure(t *testing.T) {
+	// makeCounter() -> func { n := 0; inc := func() -> int { n = n + 1; return n }; n = 10; return inc }
+	makeCounter, err := stackvm.NewFuncProto(0, func(b *stackvm.FuncProtoBuilder) {
+		inc, err := stackvm.NewFuncProto(0, func(b *stackvm.FuncProtoBuilder) {
+			n := b.CaptureLocal(0)
+			b.Emit(stackvm.GETUPVAL(n))
+			b.Emit(stackvm.PUSHI(1))
+			b.Emit(stackvm.ADDI())
+			b.Emit(stackvm.DUP(0))
+			b.Emit(stackvm.SETUPVAL(n))
+			b.Emit(stackvm.RET(1))
+		})
+		require.NoError(t, err)
+		b.Emit(stackvm.PUSHI(0))
+		b.Emit(stackvm.CLOSURE(b.AddProto(inc)))
+		b.Emit(stackvm.PUSHI(10))
+		b.Emit(stackvm.POP(0))
+		b.Emit(stackvm.RET(1))
+	})
+	require.NoError(t, err)
+
+	// main(makeCounter:func) -> (int, int) { c := makeCounter(); return c(), c() }
+	main, err := stackvm.NewFuncProto(1, func(b *stackvm.FuncProtoBuilder) {
+		b.Emit(stackvm.DUP(0))
+		b.Emit(stackvm.CALL(0, 1))
+		b.Emit(stackvm.DUP(1))
+		b.Emit(stackvm.CALL(0, 1))
+		b.Emit(stackvm.DUP(1))
+		b.Emit(stackvm.CALL(0, 1))
+		b.Emit(stackvm.PUSHI(100))
+		b.Emit(stackvm.MULI())
+		b.Emit(stackvm.ADDI())
+		b.Emit(stackvm.RET(1))
+	})
+	require.NoError(t, err)
+
+	vm := stackvm.New()
+	values, err := vm.Run(main, stackvm.NewFunction(vm, makeCounter))
+	require.NoError(t, err)
+	require.Equal(t, []stackvm.Value{stackvm.NewInt(1211)}, values)
+}
+
+func TestVM_Verification(t *testing.T) {
+	prog, err := stackvm.NewFuncProto(0, func(b *stackvm.FuncProtoBuilder) {
+		b.Emit(stackvm.PUSHI(1))
+		b.Emit(stackvm.Inst(0xFFFF << 48))
+		b.Emit(stackvm.RET(1))
+	})
+	require.NoError(t, err)
+
+	vm := stackvm.New(stackvm.WithVerification())
+	_, err = vm.Run(prog)
+	require.ErrorIs(t, err, stackvm.ErrInvalidProgram)
+
+	t.Run("shared prototype", func(t *testing.T) {
+		proto, err := stackvm.NewFuncProto(1, func(b *stackvm.FuncProtoBuilder) {
+			b.Emit(stackvm.PUSHI(1))
+			b.Emit(stackvm.ADDI())
+			b.Emit(stackvm.RET(1))
+		})
+		require.NoError(t, err)
+
+		var wg sync.WaitGroup
+		for i := range 8 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				values, err := stackvm.New(stackvm.WithVerification()).Run(proto, stackvm.NewInt(int32(i)))
+				assert.NoError(t, err)
+				assert.Equal(t, []stackvm.Value{stackvm.NewInt(int32(i) + 1)}, values)
+			}()
+		}
+		wg.Wait()
+	})
+}
+
+func TestVM_InstructionLimit(t *testing.T) {
+	forever, err := stackvm.NewFuncProto(0, func(b *stackvm.FuncProtoBuilder) {
+		b.Emit(stackvm.NOP())
+		b.Emit(stackvm.JMP(0))
+	})
+	require.NoError(t, err)
+
+	vm := stackvm.New(stackvm.WithInstructionLimit(100))
+	_, err = vm.Run(forever)
+	require.ErrorIs(t, err, stackvm.ErrBudgetExceeded)
+	require.Equal(t, uint64(100), vm.BudgetUsed())
+
+	vm = stackvm.New(
+		stackvm.WithInstructionLimit(50),
+		stackvm.WithInstructionCosts(map[string]uint64{"jmp": 10}),
+	)
+	_, err = vm.Run(forever)
+	require.ErrorIs(t, err, stackvm.ErrBudgetExceeded)
+	require.Equal(t, uint64(45), vm.BudgetUsed())
+}
+
+func TestVM_RunContext(t *testing.T) {
+	forever, err := stackvm.NewFuncProto(0, func(b *stackvm.FuncProtoBuilder) {
+		b.Emit(stackvm.JMP(0))
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	vm := stackvm.New()
+	_, err = vm.RunContext(ctx, forever)
+	require.ErrorIs(t, err, stackvm.ErrInterrupted)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestVM_Step(t *testing.T) {
+	// f(a) { return a + 1 }
+	proto, err := stackvm.NewFuncProto(1, func(b *stackvm.FuncProtoBuilder) {
+		b.Emit(stackvm.DUP(0))
+		b.Emit(stackvm.PUSHI(1))
+		b.Emit(stackvm.ADDI())
+		b.Emit(stackvm.RET(1))
+	})
+	require.NoError(t, err)
+
+	vm := stackvm.New()
+	assert.Equal(t, stackvm.StatusIdle, vm.Status())
+	assert.ErrorIs(t, vm.Step(), stackvm.ErrIllegalState)
+
+	require.NoError(t, vm.Start(proto, stackvm.NewInt(2)))
+	assert.Equal(t, stackvm.StatusRunning, vm.Status())
+	assert.ErrorIs(t, vm.Start(proto, stackvm.NewInt(2)), stackvm.ErrIllegalState)
+	for ip := stackvm.InstPtr(0); ip < 4; ip++ {
+		assert.Equal(t, ip, vm.Location().IP)
+		require.NoError(t, vm.Step())
+	}
+	assert.Equal(t, stackvm.StatusDone, vm.Status())
+	assert.Equal(t, []stackvm.Value{stackvm.NewInt(3)}, vm.Results())
+	assert.ErrorIs(t, vm.Step(), stackvm.ErrIllegalState)
+
+	t.Run("fault", func(t *testing.T) {
+		vm := stackvm.New()
+		require.NoError(t, vm.Start(proto, stackvm.NewString("2")))
+		require.NoError(t, vm.Step())
+		require.NoError(t, vm.Step())
+		assert.ErrorIs(t, vm.Step(), stackvm.ErrTypeMismatch)
+		assert.Equal(t, stackvm.StatusFaulted, vm.Status())
+	})
+}
+
+func TestVM_RunUntil(t *testing.T) {
+	// f(a) { return a + 1 }
+	proto, err := stackvm.NewFuncProto(1, func(b *stackvm.FuncProtoBuilder) {
+		b.Emit(stackvm.DUP(0))
+		b.Emit(stackvm.PUSHI(1))
+		b.Emit(stackvm.ADDI())
+		b.Emit(stackvm.RET(1))
+	})
+	require.NoError(t, err)
+
+	vm := stackvm.New()
+	require.NoError(t, vm.Start(proto, stackvm.NewInt(2)))
+	breakpoint := func(vm *stackvm.VirtualMachine) bool { return vm.Location().IP == 2 }
+	values, err := vm.RunUntil(context.Background(), breakpoint)
+	require.NoError(t, err)
+	assert.Empty(t, values)
+	assert.Equal(t, stackvm.StatusRunning, vm.Status())
+	assert.Equal(t, stackvm.InstPtr(2), vm.Location().IP)
+
+	values, err = vm.RunUntil(context.Background(), nil)
+	require.NoError(t, err)
+	assert.Equal(t, []stackvm.Value{stackvm.NewInt(3)}, values)
+	assert.Equal(t, stackvm.StatusDone, vm.Status())
+}
+
+func TestVM_Suspend(t *testing.T) {
+	fetch := stackvm.NewHostFunction("fetch", func(vm *stackvm.VirtualMachine, args []stackvm.Value) ([]stackvm.Value, error) {
+		return nil, vm.Suspend()
+	})
+
+	// f(a) { return fetch(a) + 1 }
+	proto, err := stackvm.NewFuncProto(1, func(b *stackvm.FuncProtoBuilder) {
+		b.Emit(stackvm.DUP(0))
+		b.Emit(stackvm.PUSHK(b.AddConst(fetch)))
+		b.Emit(stackvm.CALL(1, 1))
+		b.Emit(stackvm.PUSHI(1))
+		b.Emit(stackvm.ADDI())
+		b.Emit(stackvm.RET(1))
+	})
+	require.NoError(t, err)
+
+	vm := stackvm.New()
+	_, err = vm.Run(proto, stackvm.NewInt(2))
+	require.ErrorIs(t, err, stackvm.ErrSuspended)
+	assert.Equal(t, stackvm.StatusSuspended, vm.Status())
+
+	_, err = vm.RunUntil(context.Background(), nil)
+	assert.ErrorIs(t, err, stackvm.ErrSuspended)
+	assert.ErrorIs(t, vm.Resume(), stackvm.ErrArityMismatch)
+
+	require.NoError(t, vm.Resume(stackvm.NewInt(41)))
+	assert.Equal(t, stackvm.StatusRunning, vm.Status())
+	values, err := vm.RunUntil(context.Background(), nil)
+	require.NoError(t, err)
+	assert.Equal(t, []stackvm.Value{stackvm.NewInt(42)}, values)
+
+	assert.ErrorIs(t, vm.Suspend(), stackvm.ErrIllegalState)
+}
+
+func TestVM_DeepRecursion(t *testing.T) {
+	// count(n, f) { if n == 0 { return 0 }; return f(n - 1, f) + 1 }
+	count, err := stackvm.NewFuncProto(2, func(b *stackvm.FuncProtoBuilder) {
+		zero := b.NewLabel()
+		b.Emit(stackvm.DUP(0))
+		b.Emit(stackvm.PUSHI(0))
+		b.Emit(stackvm.EQI())
+		b.EmitBranch(zero)
+		b.Emit(stackvm.DUP(0))
+		b.Emit(stackvm.PUSHI(1))
+		b.Emit(stackvm.SUBI())
+		b.Emit(stackvm.DUP(1))
+		b.Emit(stackvm.DUP(1))
+		b.Emit(stackvm.CALL(2, 1))
+		b.Emit(stackvm.PUSHI(1))
+		b.Emit(stackvm.ADDI())
+		b.Emit(stackvm.RET(1))
+		b.Mark(zero)
+		b.Emit(stackvm.PUSHI(0))
+		b.Emit(stackvm.RET(1))
+	})
+	require.NoError(t, err)
+
+	run := func(vm *stackvm.VirtualMachine, n int32) ([]stackvm.Value, error) {
+		return vm.Run(count, stackvm.NewInt(n), stackvm.NewFunction(vm, count))
+	}
+
+	t.Run("grows up to the stack limit", func(t *testing.T) {
+		vm := stackvm.New(stackvm.WithStackLimit(100_000), stackvm.WithCallDepthLimit(0))
+		values, err := run(vm, 20_000)
+		require.NoError(t, err)
+		assert.Equal(t, []stackvm.Value{stackvm.NewInt(20_000)}, values)
+	})
+
+	t.Run("stack limit", func(t *testing.T) {
+		vm := stackvm.New(stackvm.WithStackLimit(1000), stackvm.WithCallDepthLimit(0))
+		_, err := run(vm, 1000)
+		var rerr *stackvm.RuntimeError
+		require.ErrorAs(t, err, &rerr)
+		require.ErrorIs(t, err, stackvm.ErrStackOverflow)
+		assert.Equal(t, stackvm.CALL(2, 1), rerr.Inst)
+	})
+
+	t.Run("call depth limit", func(t *testing.T) {
+		_, err := run(stackvm.New(stackvm.WithCallDepthLimit(100)), 99)
+		require.NoError(t, err)
+		_, err = run(stackvm.New(stackvm.WithCallDepthLimit(100)), 100)
+		require.ErrorIs(t, err, stackvm.ErrStackOverflow)
+		assert.ErrorContains(t, err, "call depth limit")
+	})
+}
+
+func TestVM_Globals(t *testing.T) {
+	// add(a) { total = total + rate * a; return total }
+	add, err := stackvm.NewFuncProto(1, func(b *stackvm.FuncProtoBuilder) {
+		total := b.AddConst(stackvm.NewString("total"))
+		b.Emit(stackvm.GETGLOBAL(total))
+		b.Emit(stackvm.GETGLOBAL(b.AddConst(stackvm.NewString("rate"))))
+		b.Emit(stackvm.DUP(0))
+		b.Emit(stackvm.MULI())
+		b.Emit(stackvm.ADDI())
+		b.Emit(stackvm.SETGLOBAL(total))
+		b.Emit(stackvm.GETGLOBAL(total))
+		b.Emit(stackvm.RET(1))
+	})
+	require.NoError(t, err)
+
+	vm := stackvm.New(stackvm.WithVerification())
+	vm.SetReadOnlyGlobal("rate", stackvm.NewInt(3))
+	vm.SetGlobal("total", stackvm.NewInt(10))
+
+	values, err := vm.Run(add, stackvm.NewInt(2))
+	require.NoError(t, err)
+	assert.Equal(t, []stackvm.Value{stackvm.NewInt(16)}, values)
+	values, err = vm.Run(add, stackvm.NewInt(1))
+	require.NoError(t, err)
+	assert.Equal(t, []stackvm.Value{stackvm.NewInt(19)}, values)
+
+	total, ok := vm.Global("total")
+	assert.True(t, ok)
+	assert.Equal(t, stackvm.NewInt(19), total)
+	_, ok = vm.Global("missing")
+	assert.False(t, ok)
+
+	t.Run("undefined", func(t *testing.T) {
+		vm := stackvm.New()
+		vm.SetGlobal("total", stackvm.NewInt(10))
+		_, err := vm.Run(add, stackvm.NewInt(2))
+		require.ErrorIs(t, err, stackvm.ErrUndefinedGlobal)
+		assert.ErrorContains(t, err, "rate")
+	})
+
+	t.Run("read-only", func(t *testing.T) {
+		vm := stackvm.New()
+		vm.SetGlobal("rate", stackvm.NewInt(3))
+		vm.SetReadOnlyGlobal("total", stackvm.NewInt(10))
+		_, err := vm.Run(add, stackvm.NewInt(2))
+		require.ErrorIs(t, err, stackvm.ErrReadOnlyGlobal)
+		total, _ := vm.Global("total")
+		assert.Equal(t, stackvm.NewInt(10), total)
+	})
+}
+
+func TestVM_Locals(t *testing.T) {
+	// sum(n) { var s, i; s = 0; i = 1; while i <= n { s = s + i; i = i + 1 }; return s }
+	sum, err := stackvm.NewFuncProto(1, func(b *stackvm.FuncProtoBuilder) {
+		s, i := b.NewLocal("s"), b.NewLocal("i")
+		done := b.NewLabel()
+		b.Emit(stackvm.PUSHI(0))
+		b.Emit(stackvm.STORE(s))
+		b.Emit(stackvm.PUSHI(1))
+		b.Emit(stackvm.STORE(i))
+		loop := b.NewLabelFixed()
+		b.Emit(stackvm.LOAD(i))
+		b.Emit(stackvm.LOAD(0))
+		b.Emit(stackvm.GTI())
+		b.EmitBranch(done)
+		b.Emit(stackvm.LOAD(s))
+		b.Emit(stackvm.LOAD(i))
+		b.Emit(stackvm.ADDI())
+		b.Emit(stackvm.STORE(s))
+		b.Emit(stackvm.LOAD(i))
+		b.Emit(stackvm.PUSHI(1))
+		b.Emit(stackvm.ADDI())
+		b.Emit(stackvm.STORE(i))
+		b.EmitJump(loop)
+		b.Mark(done)
+		b.Emit(stackvm.LOAD(s))
+		b.Emit(stackvm.RET(1))
+	})
+	require.NoError(t, err)
+
+	values, err := stackvm.New(stackvm.WithVerification()).Run(sum, stackvm.NewInt(4))
+	require.NoError(t, err)
+	assert.Equal(t, []stackvm.Value{stackvm.NewInt(10)}, values)
+
+	t.Run("locals start as none", func(t *testing.T) {
+		proto, err := stackvm.NewFuncProto(0, func(b *stackvm.FuncProtoBuilder) {
+			b.Emit(stackvm.LOAD(b.NewLocal("x")))
+			b.Emit(stackvm.RET(1))
+		})
+		require.NoError(t, err)
+		values, err := stackvm.New(stackvm.WithVerification()).Run(proto)
+		require.NoError(t, err)
+		assert.Equal(t, []stackvm.Value{stackvm.NoValue}, values)
+	})
+}
+
+func TestVM_MultipleResults(t *testing.T) {
+	// divmod(a, b) -> (int, int) { return a / b, a % b }
+	divmod, err := stackvm.NewFuncProto(2, func(b *stackvm.FuncProtoBuilder) {
+		b.SetResults(2)
+		b.Emit(stackvm.LOAD(0))
+		b.Emit(stackvm.LOAD(1))
+		b.Emit(stackvm.DIVI())
+		b.Emit(stackvm.LOAD(0))
+		b.Emit(stackvm.LOAD(1))
+		b.Emit(stackvm.MODI())
+		b.Emit(stackvm.RET(2))
+	})
+	require.NoError(t, err)
+
+	// main() { q, r := divmod(17, 5); return r, q }
+	main, err := stackvm.NewFuncProto(0, func(b *stackvm.FuncProtoBuilder) {
+		b.Emit(stackvm.PUSHI(17))
+		b.Emit(stackvm.PUSHI(5))
+		b.Emit(stackvm.PUSHK(b.AddProto(divmod)))
+		b.Emit(stackvm.CALL(2, 2))
+		b.Emit(stackvm.DUP(1))
+		b.Emit(stackvm.DUP(0))
+		b.Emit(stackvm.RET(2))
+	})
+	require.NoError(t, err)
+
+	values, err := stackvm.New(stackvm.WithVerification()).Run(main)
+	require.NoError(t, err)
+	assert.Equal(t, []stackvm.Value{stackvm.NewInt(2), stackvm.NewInt(3)}, values)
+
+	t.Run("variadic return", func(t *testing.T) {
+		// all(a, b) { return a, b, "end" }
+		all, err := stackvm.NewFuncProto(2, func(b *stackvm.FuncProtoBuilder) {
+			b.Emit(stackvm.PUSHK(b.AddConst(stackvm.NewString("end"))))
+			b.Emit(stackvm.RETV(0))
+		})
+		require.NoError(t, err)
+		values, err := stackvm.New(stackvm.WithVerification()).Run(all, stackvm.NewInt(1), stackvm.NewInt(2))
+		require.NoError(t, err)
+		assert.Equal(t, []stackvm.Value{stackvm.NewInt(1), stackvm.NewInt(2), stackvm.NewString("end")}, values)
+	})
+
+	t.Run("declared results mismatch", func(t *testing.T) {
+		main, err := stackvm.NewFuncProto(0, func(b *stackvm.FuncProtoBuilder) {
+			b.Emit(stackvm.PUSHI(17))
+			b.Emit(stackvm.PUSHI(5))
+			b.Emit(stackvm.PUSHK(b.AddProto(divmod)))
+			b.Emit(stackvm.CALL(2, 1))
+			b.Emit(stackvm.RET(1))
+		})
+		require.NoError(t, err)
+		_, err = stackvm.New().Run(main)
+		assert.ErrorIs(t, err, stackvm.ErrArityMismatch)
+	})
+
+	t.Run("variadic return mismatch", func(t *testing.T) {
+		proto, err := stackvm.NewFuncProto(1, func(b *stackvm.FuncProtoBuilder) {
+			b.SetResults(2)
+			b.Emit(stackvm.RETV(0))
+		})
+		require.NoError(t, err)
+		_, err = stackvm.New().Run(proto, stackvm.NewInt(1))
+		assert.ErrorIs(t, err, stackvm.ErrArityMismatch)
+		_, err = stackvm.New(stackvm.WithVerification()).Run(proto, stackvm.NewInt(1))
+		assert.ErrorIs(t, err, stackvm.ErrInvalidProgram)
+	})
+}
+
+func TestVM_Variadic(t *testing.T) {
+	// sum(base, ...) { var i; s := base; for i = 0; i < #...; i++ { s = s + ...[i] }; return s }
+	sum, err := stackvm.NewFuncProto(1, func(b *stackvm.FuncProtoBuilder) {
+		b.SetVariadic()
+		i := b.NewLocal("i")
+		done := b.NewLabel()
+		b.Emit(stackvm.PUSHI(0))
+		b.Emit(stackvm.STORE(i))
+		loop := b.NewLabelFixed()
+		b.Emit(stackvm.LOAD(i))
+		b.Emit(stackvm.VARARGN())
+		b.Emit(stackvm.GEI())
+		b.EmitBranch(done)
+		b.Emit(stackvm.LOAD(0))
+		b.Emit(stackvm.LOAD(i))
+		b.Emit(stackvm.VARARG())
+		b.Emit(stackvm.ADDI())
+		b.Emit(stackvm.STORE(0))
+		b.Emit(stackvm.LOAD(i))
+		b.Emit(stackvm.PUSHI(1))
+		b.Emit(stackvm.ADDI())
+		b.Emit(stackvm.STORE(i))
+		b.EmitJump(loop)
+		b.Mark(done)
+		b.Emit(stackvm.LOAD(0))
+		b.Emit(stackvm.RET(1))
+	})
+	require.NoError(t, err)
+
+	vm := stackvm.New(stackvm.WithVerification())
+	values, err := vm.Run(sum, stackvm.NewInt(100), stackvm.NewInt(1), stackvm.NewInt(2), stackvm.NewInt(3))
+	require.NoError(t, err)
+	assert.Equal(t, []stackvm.Value{stackvm.NewInt(106)}, values)
+
+	values, err = vm.Run(sum, stackvm.NewInt(100))
+	require.NoError(t, err)
+	assert.Equal(t, []stackvm.Value{stackvm.NewInt(100)}, values)
+
+	t.Run("call with extra arguments", func(t *testing.T) {
+		main, err := stackvm.NewFuncProto(0, func(b *stackvm.FuncProtoBuilder) {
+			b.Emit(stackvm.PUSHI(10))
+			b.Emit(stackvm.PUSHI(20))
+			b.Emit(stackvm.PUSHK(b.AddProto(sum)))
+			b.Emit(stackvm.CALL(2, 1))
+			b.Emit(stackvm.PUSHI(1))
+			b.Emit(stackvm.ADDI())
+			b.Emit(stackvm.RET(1))
+		})
+		require.NoError(t, err)
+		values, err := stackvm.New(stackvm.WithVerification()).Run(main)
+		require.NoError(t, err)
+		assert.Equal(t, []stackvm.Value{stackvm.NewInt(31)}, values)
+	})
+
+	t.Run("too few arguments", func(t *testing.T) {
+		vm := stackvm.New()
+		_, err := vm.Run(sum)
+		assert.ErrorIs(t, err, stackvm.ErrArityMismatch)
+
+		main, err := stackvm.NewFuncProto(0, func(b *stackvm.FuncProtoBuilder) {
+			b.Emit(stackvm.PUSHK(b.AddProto(sum)))
+			b.Emit(stackvm.CALL(0, 1))
+			b.Emit(stackvm.RET(1))
+		})
+		require.NoError(t, err)
+		_, err = vm.Run(main)
+		assert.ErrorIs(t, err, stackvm.ErrArityMismatch)
+	})
+
+	t.Run("too many arguments to fixed function", func(t *testing.T) {
+		proto, err := stackvm.NewFuncProto(1, func(b *stackvm.FuncProtoBuilder) {
+			b.Emit(stackvm.RET(1))
+		})
+		require.NoError(t, err)
+		_, err = stackvm.New().Run(proto, stackvm.NewInt(1), stackvm.NewInt(2))
+		assert.ErrorIs(t, err, stackvm.ErrArityMismatch)
+	})
+
+	t.Run("vararg out of range", func(t *testing.T) {
+		proto, err := stackvm.NewFuncProto(0, func(b *stackvm.FuncProtoBuilder) {
+			b.SetVariadic()
+			b.Emit(stackvm.PUSHI(1))
+			b.Emit(stackvm.VARARG())
+			b.Emit(stackvm.RET(1))
+		})
+		require.NoError(t, err)
+		_, err = stackvm.New().Run(proto, stackvm.NewInt(1))
+		assert.ErrorIs(t, err, stackvm.ErrArityMismatch)
+	})
+}
+
+func TestVM_Signature(t *testing.T) {
+	// repeat(s: string, n: int) -> string { r := ""; while n > 0 { r = concat(r, s); n = n - 1 }; return r }
+	concat := stackvm.NewHostFunction("concat", func(vm *stackvm.VirtualMachine, args []stackvm.Value) ([]stackvm.Value, error) {
+		a, _ := args[0].AsString()
+		b, _ := args[1].AsString()
+		return []stackvm.Value{stackvm.NewString(a + b)}, nil
+	})
+	repeat, err := stackvm.NewFuncProto(2, func(b *stackvm.FuncProtoBuilder) {
+		b.SetParamTypes(stackvm.TypeString, stackvm.TypeInt)
+		b.SetResultTypes(stackvm.TypeString)
+		r := b.NewLocal("r")
+		done := b.NewLabel()
+		b.Emit(stackvm.PUSHK(b.AddConst(stackvm.NewString(""))))
+		b.Emit(stackvm.STORE(r))
+		loop := b.NewLabelFixed()
+		b.Emit(stackvm.LOAD(1))
+		b.Emit(stackvm.PUSHI(0))
+		b.Emit(stackvm.LEI())
+		b.EmitBranch(done)
+		b.Emit(stackvm.LOAD(r))
+		b.Emit(stackvm.LOAD(0))
+		b.Emit(stackvm.PUSHK(b.AddConst(concat)))
+		b.Emit(stackvm.CALL(2, 1))
+		b.Emit(stackvm.STORE(r))
+		b.Emit(stackvm.LOAD(1))
+		b.Emit(stackvm.PUSHI(1))
+		b.Emit(stackvm.SUBI())
+		b.Emit(stackvm.STORE(1))
+		b.EmitJump(loop)
+		b.Mark(done)
+		b.Emit(stackvm.LOAD(r))
+		b.Emit(stackvm.RET(1))
+	})
+	require.NoError(t, err)
+
+	vm := stackvm.New(stackvm.WithVerification())
+	values, err := vm.Run(repeat, stackvm.NewString("ab"), stackvm.NewInt(3))
+	require.NoError(t, err)
+	assert.Equal(t, []stackvm.Value{stackvm.NewString("ababab")}, values)
+
+	t.Run("argument type mismatch", func(t *testing.T) {
+		_, err := vm.Run(repeat, stackvm.NewInt(3), stackvm.NewString("ab"))
+		require.ErrorIs(t, err, stackvm.ErrTypeMismatch)
+		assert.Contains(t, err.Error(), "argument 0 expected string, got int")
+	})
+
+	t.Run("argument count mismatch", func(t *testing.T) {
+		_, err := vm.Run(repeat, stackvm.NewString("ab"))
+		assert.ErrorIs(t, err, stackvm.ErrArityMismatch)
+		_, err = vm.Run(repeat, stackvm.NewString("ab"), stackvm.NewInt(1), stackvm.NewInt(1))
+		assert.ErrorIs(t, err, stackvm.ErrArityMismatch)
+	})
+
+	t.Run("argument type mismatch on call", func(t *testing.T) {
+		main, err := stackvm.NewFuncProto(0, func(b *stackvm.FuncProtoBuilder) {
+			b.Emit(stackvm.PUSHK(b.AddConst(stackvm.NewString("ab"))))
+			b.Emit(stackvm.PUSHF(2))
+			b.Emit(stackvm.PUSHK(b.AddProto(repeat)))
+			b.Emit(stackvm.CALL(2, 1))
+			b.Emit(stackvm.RET(1))
+		})
+		require.NoError(t, err)
+		_, err = vm.Run(main)
+		assert.ErrorIs(t, err, stackvm.ErrTypeMismatch)
+	})
+
+	t.Run("result type mismatch", func(t *testing.T) {
+		proto, err := stackvm.NewFuncProto(1, func(b *stackvm.FuncProtoBuilder) {
+			b.SetResultTypes(stackvm.TypeInt)
+			b.Emit(stackvm.RET(1))
+		})
+		require.NoError(t, err)
+		values, err := vm.Run(proto, stackvm.NewInt(1))
+		require.NoError(t, err)
+		assert.Equal(t, []stackvm.Value{stackvm.NewInt(1)}, values)
+		_, err = vm.Run(proto, stackvm.NewBool(true))
+		require.ErrorIs(t, err, stackvm.ErrTypeMismatch)
+		assert.Contains(t, err.Error(), "result 0 expected int, got bool")
+	})
+
+	t.Run("parameter types count mismatch", func(t *testing.T) {
+		_, err := stackvm.NewFuncProto(2, func(b *stackvm.FuncProtoBuilder) {
+			b.SetParamTypes(stackvm.TypeInt)
+			b.Emit(stackvm.RET(0))
+		})
+		assert.ErrorIs(t, err, stackvm.ErrInvalidProgram)
+	})
+}
+
+func TestVM_Arithmetic(t *testing.T) {
+	binary := func(inst stackvm.Inst) *stackvm.FuncProto {
+		proto, err := stackvm.NewFuncProto(2, func(b *stackvm.FuncProtoBuilder) {
+			b.Emit(inst)
+			b.Emit(stackvm.RET(1))
+		})
+		require.NoError(t, err)
+		return proto
+	}
+	maxInt, minInt := stackvm.NewInt(math.MaxInt32), stackvm.NewInt(math.MinInt32)
+	one, zero := stackvm.NewInt(1), stackvm.NewInt(0)
+
+	for _, test := range []struct {
+		name     string
+		opts     []stackvm.Option
+		inst     stackvm.Inst
+		args     []stackvm.Value
+		expected stackvm.Value
+		err      error
+	}{
+		{name: "div by zero", inst: stackvm.DIVI(), args: []stackvm.Value{one, zero}, err: stackvm.ErrArithmetic},
+		{name: "mod by zero", inst: stackvm.MODI(), args: []stackvm.Value{one, zero}, err: stackvm.ErrArithmetic},
+		{name: "wrap", inst: stackvm.ADDI(), args: []stackvm.Value{maxInt, one}, expected: minInt},
+		{name: "wrap min div", inst: stackvm.DIVI(), args: []stackvm.Value{minInt, stackvm.NewInt(-1)}, expected: minInt},
+		{
+			name: "trap",
+			opts: []stackvm.Option{stackvm.WithIntegerMode(stackvm.IntegerTrap)},
+			inst: stackvm.MULI(),
+			args: []stackvm.Value{maxInt, stackvm.NewInt(2)},
+			err:  stackvm.ErrArithmetic,
+		},
+		{
+			name:     "saturate",
+			opts:     []stackvm.Option{stackvm.WithIntegerMode(stackvm.IntegerSaturate)},
+			inst:     stackvm.SUBI(),
+			args:     []stackvm.Value{minInt, one},
+			expected: minInt,
+		},
+		{
+			name:     "saturate min div",
+			opts:     []stackvm.Option{stackvm.WithIntegerMode(stackvm.IntegerSaturate)},
+			inst:     stackvm.DIVI(),
+			args:     []stackvm.Value{minInt, stackvm.NewInt(-1)},
+			expected: maxInt,
+		},
+		{name: "checked add", inst: stackvm.ADDIC(), args: []stackvm.Value{maxInt, one}, err: stackvm.ErrArithmetic},
+		{name: "checked sub", inst: stackvm.SUBIC(), args: []stackvm.Value{one, maxInt}, expected: stackvm.NewInt(-math.MaxInt32 + 1)},
+		{
+			name: "checked mul ignores mode",
+			opts: []stackvm.Option{stackvm.WithIntegerMode(stackvm.IntegerSaturate)},
+			inst: stackvm.MULIC(),
+			args: []stackvm.Value{minInt, stackvm.NewInt(2)},
+			err:  stackvm.ErrArithmetic,
+		},
+		{
+			name:     "float infinity",
+			inst:     stackvm.DIVF(),
+			args:     []stackvm.Value{stackvm.NewFloat(1), stackvm.NewFloat(0)},
+			expected: stackvm.NewFloat(float32(math.Inf(1))),
+		},
+		{
+			name: "float trap",
+			opts: []stackvm.Option{stackvm.WithFloatPolicy(stackvm.FloatTrap)},
+			inst: stackvm.DIVF(),
+			args: []stackvm.Value{stackvm.NewFloat(0), stackvm.NewFloat(0)},
+			err:  stackvm.ErrArithmetic,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			values, err := stackvm.New(test.opts...).Run(binary(test.inst), test.args...)
+			if test.err != nil {
+				assert.ErrorIs(t, err, test.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, []stackvm.Value{test.expected}, values)
+		})
+	}
+
+	t.Run("checked negate", func(t *testing.T) {
+		proto, err := stackvm.NewFuncProto(1, func(b *stackvm.FuncProtoBuilder) {
+			b.Emit(stackvm.NEGIC())
+			b.Emit(stackvm.RET(1))
+		})
+		require.NoError(t, err)
+		_, err = stackvm.New().Run(proto, minInt)
+		assert.ErrorIs(t, err, stackvm.ErrArithmetic)
+	})
+}
+
+func TestVM_Reset(t *testing.T) {
+	// half(a) { return a / 2 }
+	half, err := stackvm.NewFuncProto(1, func(b *stackvm.FuncProtoBuilder) {
+		b.Emit(stackvm.PUSHI(2))
+		b.Emit(stackvm.DIVI())
+		b.Emit(stackvm.RET(1))
+	})
+	require.NoError(t, err)
+
+	t.Run("reuse after failed run", func(t *testing.T) {
+		vm := stackvm.New()
+		_, err := vm.Run(half, stackvm.NewFloat(1))
+		require.ErrorIs(t, err, stackvm.ErrTypeMismatch)
+		assert.Equal(t, stackvm.StatusFaulted, vm.Status())
+		assert.Equal(t, stackvm.TraceEntry{}, vm.Location())
+
+		values, err := vm.Run(half, stackvm.NewInt(8))
+		require.NoError(t, err)
+		assert.Equal(t, []stackvm.Value{stackvm.NewInt(4)}, values)
+	})
+
+	t.Run("discard suspended run", func(t *testing.T) {
+		wait := stackvm.NewHostFunction("wait", func(vm *stackvm.VirtualMachine, args []stackvm.Value) ([]stackvm.Value, error) {
+			return nil, vm.Suspend()
+		})
+		main, err := stackvm.NewFuncProto(0, func(b *stackvm.FuncProtoBuilder) {
+			b.Emit(stackvm.PUSHI(1))
+			b.Emit(stackvm.SETGLOBAL(b.AddConst(stackvm.NewString("seen"))))
+			b.Emit(stackvm.PUSHK(b.AddConst(wait)))
+			b.Emit(stackvm.CALL(0, 1))
+			b.Emit(stackvm.RET(1))
+		})
+		require.NoError(t, err)
+
+		vm := stackvm.New()
+		_, err = vm.Run(main)
+		require.ErrorIs(t, err, stackvm.ErrSuspended)
+		require.NoError(t, vm.Reset())
+		assert.Equal(t, stackvm.StatusIdle, vm.Status())
+		seen, ok := vm.Global("seen")
+		assert.True(t, ok)
+		assert.Equal(t, stackvm.NewInt(1), seen)
+
+		values, err := vm.Run(half, stackvm.NewInt(6))
+		require.NoError(t, err)
+		assert.Equal(t, []stackvm.Value{stackvm.NewInt(3)}, values)
+	})
+
+	t.Run("busy", func(t *testing.T) {
+		reset := stackvm.NewHostFunction("reset", func(vm *stackvm.VirtualMachine, args []stackvm.Value) ([]stackvm.Value, error) {
+			return nil, vm.Reset()
+		})
+		main, err := stackvm.NewFuncProto(0, func(b *stackvm.FuncProtoBuilder) {
+			b.Emit(stackvm.PUSHK(b.AddConst(reset)))
+			b.Emit(stackvm.CALL(0, 0))
+			b.Emit(stackvm.RET(0))
+		})
+		require.NoError(t, err)
+		_, err = stackvm.New().Run(main)
+		assert.ErrorIs(t, err, stackvm.ErrIllegalState)
+	})
+}
+
+func TestVM_Wide(t *testing.T) {
+	// total(a, b: int64) -> (int64, bool) { s := a + b; return s, s > 10^10 }
+	total, err := stackvm.Assemble(strings.NewReader(`
+.func total 2
+.paramtypes int64 int64
+.resulttypes int64 bool
+	ADDL
+	DUP 0
+	PUSHK 10000000000L
+	GTL
+	RET 2
+.end
+`))
+	require.NoError(t, err)
+
+	values, err := stackvm.New(stackvm.WithVerification()).Run(total, stackvm.NewInt64(8_000_000_000), stackvm.NewInt64(3_000_000_000))
+	require.NoError(t, err)
+	assert.Equal(t, []stackvm.Value{stackvm.NewInt64(11_000_000_000), stackvm.NewBool(true)}, values)
+
+	t.Run("float arithmetic", func(t *testing.T) {
+		proto, err := stackvm.NewFuncProto(1, func(b *stackvm.FuncProtoBuilder) {
+			b.Emit(stackvm.F2D())
+			b.Emit(stackvm.PUSHK(b.AddConst(stackvm.NewFloat64(0.1))))
+			b.Emit(stackvm.ADDD())
+			b.Emit(stackvm.DUP(0))
+			b.Emit(stackvm.PUSHK(b.AddConst(stackvm.NewFloat64(0.6))))
+			b.Emit(stackvm.LTD())
+			b.Emit(stackvm.RET(2))
+		})
+		require.NoError(t, err)
+		values, err := stackvm.New(stackvm.WithVerification()).Run(proto, stackvm.NewFloat(0.5))
+		require.NoError(t, err)
+		assert.Equal(t, []stackvm.Value{stackvm.NewFloat64(0.6), stackvm.NewBool(false)}, values)
+	})
+
+	t.Run("arithmetic", func(t *testing.T) {
+		proto, err := stackvm.NewFuncProto(2, func(b *stackvm.FuncProtoBuilder) {
+			b.SetParamTypes(stackvm.TypeInt64, stackvm.TypeInt64)
+			b.Emit(stackvm.ADDL())
+			b.Emit(stackvm.PUSHK(b.AddConst(stackvm.NewInt64(3))))
+			b.Emit(stackvm.MULL())
+			b.Emit(stackvm.PUSHK(b.AddConst(stackvm.NewInt64(-7))))
+			b.Emit(stackvm.MODL())
+			b.Emit(stackvm.NEGL())
+			b.Emit(stackvm.RET(1))
+		})
+		require.NoError(t, err)
+		values, err := stackvm.New(stackvm.WithVerification()).Run(proto, stackvm.NewInt64(1<<40), stackvm.NewInt64(5))
+		require.NoError(t, err)
+		assert.Equal(t, []stackvm.Value{stackvm.NewInt64(-((1<<40 + 5) * 3 % -7))}, values)
+	})
+
+	t.Run("overflow", func(t *testing.T) {
+		proto, err := stackvm.NewFuncProto(2, func(b *stackvm.FuncProtoBuilder) {
+			b.Emit(stackvm.MULL())
+			b.Emit(stackvm.RET(1))
+		})
+		require.NoError(t, err)
+		args := []stackvm.Value{stackvm.NewInt64(math.MaxInt64), stackvm.NewInt64(-2)}
+
+		values, err := stackvm.New().Run(proto, args...)
+		require.NoError(t, err)
+		assert.Equal(t, []stackvm.Value{stackvm.NewInt64(2)}, values)
+		values, err = stackvm.New(stackvm.WithIntegerMode(stackvm.IntegerSaturate)).Run(proto, args...)
+		require.NoError(t, err)
+		assert.Equal(t, []stackvm.Value{stackvm.NewInt64(math.MinInt64)}, values)
+		_, err = stackvm.New(stackvm.WithIntegerMode(stackvm.IntegerTrap)).Run(proto, args...)
+		assert.ErrorIs(t, err, stackvm.ErrArithmetic)
+	})
+
+	t.Run("conversions", func(t *testing.T) {
+		proto, err := stackvm.NewFuncProto(2, func(b *stackvm.FuncProtoBuilder) {
+			b.Emit(stackvm.L2I())
+			b.Emit(stackvm.DUP(0))
+			b.Emit(stackvm.D2F())
+			b.Emit(stackvm.RET(2))
+		})
+		require.NoError(t, err)
+		values, err := stackvm.New().Run(proto, stackvm.NewFloat64(0.25), stackvm.NewInt64(1<<32+1))
+		require.NoError(t, err)
+		assert.Equal(t, []stackvm.Value{stackvm.NewInt(1), stackvm.NewFloat(0.25)}, values)
+
+		_, err = stackvm.New(stackvm.WithIntegerMode(stackvm.IntegerTrap)).Run(proto, stackvm.NewFloat64(0.25), stackvm.NewInt64(1<<32+1))
+		assert.ErrorIs(t, err, stackvm.ErrArithmetic)
+		_, err = stackvm.New(stackvm.WithFloatPolicy(stackvm.FloatTrap)).Run(proto, stackvm.NewFloat64(math.MaxFloat64), stackvm.NewInt64(1))
+		assert.ErrorIs(t, err, stackvm.ErrArithmetic)
+	})
+}
+
+func TestVM_UnknownOpcode(t *testing.T) {
+	proto, err := stackvm.NewFuncProto(0, func(b *stackvm.FuncProtoBuilder) {
+		b.Emit(stackvm.Inst(0xFFFF) << 48)
+	})
+	require.NoError(t, err)
+	_, err = stackvm.New().Run(proto)
+	assert.ErrorIs(t, err, stackvm.ErrInvalidProgram)
+}
+
+func TestVM_RuntimeError(t *testing.T) {
+	proto, err := stackvm.Assemble(strings.NewReader(`
+.func half 1
+	DUP 0
+	PUSHI 2
+	DIVI
+	RET 1
+.end
+
+.func main 0
+	PUSHF 3.0
+	PUSHK half
+	CALL 1, 1
+	RET 1
+.end
+`))
+	require.NoError(t, err)
+
+	_, err = stackvm.New().Run(proto)
+	require.ErrorIs(t, err, stackvm.ErrTypeMismatch)
+
+	var rerr *stackvm.RuntimeError
+	require.ErrorAs(t, err, &rerr)
+	assert.Equal(t, stackvm.DIVI(), rerr.Inst)
+	assert.Equal(t, stackvm.InstPtr(2), rerr.IP)
+	assert.Equal(t, []stackvm.TraceEntry{
+		{Function: "half", IP: 2, Pos: stackvm.Position{Line: 5, Column: 2}},
+		{Function: "main", IP: 2, Pos: stackvm.Position{Line: 12, Column: 2}},
+	}, rerr.Trace)
+	assert.EqualError(t, err, "type mismatch: expected int, got float [DIVI at half+0002 (5:2)]")
+	assert.Equal(t, "\tat half+0002 (5:2)\n\tat main+0002 (12:2)\n", rerr.Traceback())
+}
+
+func TestVM_Exceptions(t *testing.T) {
+	// fail() { throw "boom" }
+	fail, err := stackvm.NewFuncProto(0, func(b *stackvm.FuncProtoBuilder) {
+		b.Emit(stackvm.PUSHK(b.AddConst(stackvm.NewString("boom"))))
+		b.Emit(stackvm.THROW())
+	})
+	require.NoError(t, err)
+
+	finallyRuns := 0
+	mark := stackvm.NewHostFunction("mark", func(vm *stackvm.VirtualMachine, args []stackvm.Value) ([]stackvm.Value, error) {
+		finallyRuns++
+		return nil, nil
+	})
+
+	// inc(a) -> int { r := 0; try { r = a + 1 } catch { r = -1 } finally { mark() }; return r }
+	inc, err := stackvm.NewFuncProto(1, func(b *stackvm.FuncProtoBuilder) {
+		b.Emit(stackvm.PUSHI(0))
+		b.EmitTry(func() {
+			b.Emit(stackvm.DUP(0))
+			b.Emit(stackvm.PUSHI(1))
+			b.Emit(stackvm.ADDI())
+			b.Emit(stackvm.POP(1))
+		}, func() {
+			b.Emit(stackvm.POP(1))
+			b.Emit(stackvm.PUSHI(-1))
+			b.Emit(stackvm.POP(1))
+		}, func() {
+			b.Emit(stackvm.PUSHK(b.AddConst(mark)))
+			b.Emit(stackvm.CALL(0, 0))
+		})
+		b.Emit(stackvm.DUP(1))
+		b.Emit(stackvm.RET(1))
+	})
+	require.NoError(t, err)
+
+	// incNoCatch(a) -> int { r := 0; try { r = a + 1 } finally { mark() }; return r }
+	incNoCatch, err := stackvm.NewFuncProto(1, func(b *stackvm.FuncProtoBuilder) {
+		b.Emit(stackvm.PUSHI(0))
+		b.EmitTry(func() {
+			b.Emit(stackvm.DUP(0))
+			b.Emit(stackvm.PUSHI(1))
+			b.Emit(stackvm.ADDI())
+			b.Emit(stackvm.POP(1))
+		}, nil, func() {
+			b.Emit(stackvm.PUSHK(b.AddConst(mark)))
+			b.Emit(stackvm.CALL(0, 0))
+		})
+		b.Emit(stackvm.DUP(1))
+		b.Emit(stackvm.RET(1))
+	})
+	require.NoError(t, err)
+
+	// catchFail() -> string { try { fail() } catch (e) { return e } }
+	catchFail, err := stackvm.NewFuncProto(0, func(b *stackvm.FuncProtoBuilder) {
+		b.Emit(stackvm.PUSHI(7))
+		b.EmitTry(func() {
+			b.Emit(stackvm.PUSHK(b.AddProto(fail)))
+			b.Emit(stackvm.CALL(0, 0))
+		}, func() {
+			b.Emit(stackvm.RET(1))
+		}, nil)
+		b.Emit(stackvm.RET(0))
+	})
+	require.NoError(t, err)
+
+	t.Run("normal exit", func(t *testing.T) {
+		finallyRuns = 0
+		values, err := stackvm.New(stackvm.WithVerification()).Run(inc, stackvm.NewInt(2))
+		require.NoError(t, err)
+		assert.Equal(t, []stackvm.Value{stackvm.NewInt(3)}, values)
+		assert.Equal(t, 1, finallyRuns)
+	})
+
+	t.Run("caught fault", func(t *testing.T) {
+		finallyRuns = 0
+		values, err := stackvm.New(stackvm.WithVerification()).Run(inc, stackvm.NewString("2"))
+		require.NoError(t, err)
+		assert.Equal(t, []stackvm.Value{stackvm.NewInt(-1)}, values)
+		assert.Equal(t, 1, finallyRuns)
+	})
+
+	t.Run("uncaught fault", func(t *testing.T) {
+		finallyRuns = 0
+		_, err := stackvm.New(stackvm.WithVerification()).Run(incNoCatch, stackvm.NewString("2"))
+		require.ErrorIs(t, err, stackvm.ErrTypeMismatch)
+		assert.Equal(t, 1, finallyRuns)
+	})
+
+	t.Run("caught exception", func(t *testing.T) {
+		values, err := stackvm.New(stackvm.WithVerification()).Run(catchFail)
+		require.NoError(t, err)
+		assert.Equal(t, []stackvm.Value{stackvm.NewString("boom")}, values)
+	})
+
+	t.Run("uncaught exception", func(t *testing.T) {
+		_, err := stackvm.New(stackvm.WithVerification()).Run(fail)
+		var exc *stackvm.Exception
+		require.ErrorAs(t, err, &exc)
+		assert.Equal(t, stackvm.NewString("boom"), exc.Value)
+		assert.EqualError(t, err, `uncaught exception: "boom" [THROW at ?+0001]`)
+	})
+
+	t.Run("rethrown internal error", func(t *testing.T) {
+		internal := stackvm.NewError(fmt.Errorf("%w: lost", stackvm.ErrInternal))
+		// rethrow() { try { throw internal } catch (e) { throw e } }
+		rethrow, err := stackvm.NewFuncProto(0, func(b *stackvm.FuncProtoBuilder) {
+			b.EmitTry(func() {
+				b.Emit(stackvm.PUSHK(b.AddConst(internal)))
+				b.Emit(stackvm.THROW())
+			}, func() {
+				b.Emit(stackvm.THROW())
+			}, nil)
+			b.Emit(stackvm.RET(0))
+		})
+		require.NoError(t, err)
+		// catchRethrow() { try { rethrow() } catch (e) { return e } }
+		catchRethrow, err := stackvm.NewFuncProto(0, func(b *stackvm.FuncProtoBuilder) {
+			b.EmitTry(func() {
+				b.Emit(stackvm.PUSHK(b.AddProto(rethrow)))
+				b.Emit(stackvm.CALL(0, 0))
+			}, func() {
+				b.Emit(stackvm.RET(1))
+			}, nil)
+			b.Emit(stackvm.RET(0))
+		})
+		require.NoError(t, err)
+
+		values, err := stackvm.New(stackvm.WithVerification()).Run(catchRethrow)
+		require.NoError(t, err)
+		assert.Equal(t, []stackvm.Value{internal}, values)
+
+		_, err = stackvm.New(stackvm.WithVerification()).Run(rethrow)
+		var exc *stackvm.Exception
+		require.ErrorAs(t, err, &exc)
+		assert.Equal(t, internal, exc.Value)
+		assert.ErrorIs(t, err, stackvm.ErrInternal)
+	})
+}
+
+func TestVM_Coroutines(t *testing.T) {
+	// gen(n) { for i := 0; i < n; i++ { yield i }; return -1 }
+	gen, err := stackvm.NewFuncProto(1, func(b *stackvm.FuncProtoBuilder) {
+		end := b.NewLabel()
+		b.Emit(stackvm.PUSHI(0))
+		loop := b.NewLabelFixed()
+		b.Emit(stackvm.DUP(1))
+		b.Emit(stackvm.DUP(0))
+		b.Emit(stackvm.GEI())
+		b.EmitBranch(end)
+		b.Emit(stackvm.DUP(1))
+		b.Emit(stackvm.YIELD(1, 0))
+		b.Emit(stackvm.DUP(1))
+		b.Emit(stackvm.PUSHI(1))
+		b.Emit(stackvm.ADDI())
+		b.Emit(stackvm.POP(1))
+		b.EmitJump(loop)
+		b.Mark(end)
+		b.Emit(stackvm.PUSHI(-1))
+		b.Emit(stackvm.RET(1))
+	})
+	require.NoError(t, err)
+
+	// acc() { s := 0; for { s += yield s } }
+	acc, err := stackvm.NewFuncProto(0, func(b *stackvm.FuncProtoBuilder) {
+		b.Emit(stackvm.PUSHI(0))
+		loop := b.NewLabelFixed()
+		b.Emit(stackvm.DUP(0))
+		b.Emit(stackvm.YIELD(1, 1))
+		b.Emit(stackvm.DUP(0))
+		b.Emit(stackvm.ADDI())
+		b.Emit(stackvm.POP(0))
+		b.EmitJump(loop)
+	})
+	require.NoError(t, err)
+
+	// fail() { throw "boom" }
+	fail, err := stackvm.NewFuncProto(0, func(b *stackvm.FuncProtoBuilder) {
+		b.Emit(stackvm.PUSHK(b.AddConst(stackvm.NewString("boom"))))
+		b.Emit(stackvm.THROW())
+	})
+	require.NoError(t, err)
+
+	t.Run("resume from bytecode", func(t *testing.T) {
+		// co := coroutine(gen); return resume(co, 3) + resume(co) + resume(co)
+		main, err := stackvm.NewFuncProto(0, func(b *stackvm.FuncProtoBuilder) {
+			b.Emit(stackvm.PUSHK(b.AddProto(gen)))
+			b.Emit(stackvm.COROUTINE())
+			b.Emit(stackvm.PUSHI(3))
+			b.Emit(stackvm.DUP(0))
+			b.Emit(stackvm.RESUME(1, 1))
+			b.Emit(stackvm.DUP(0))
+			b.Emit(stackvm.RESUME(0, 1))
+			b.Emit(stackvm.ADDI())
+			b.Emit(stackvm.DUP(0))
+			b.Emit(stackvm.RESUME(0, 1))
+			b.Emit(stackvm.ADDI())
+			b.Emit(stackvm.RET(1))
+		})
+		require.NoError(t, err)
+		values, err := stackvm.New(stackvm.WithVerification()).Run(main)
+		require.NoError(t, err)
+		assert.Equal(t, []stackvm.Value{stackvm.NewInt(3)}, values)
+	})
+
+	t.Run("resume from host", func(t *testing.T) {
+		vm := stackvm.New(stackvm.WithVerification())
+		v, err := stackvm.NewCoroutine(vm, stackvm.NewFunction(vm, gen))
+		require.NoError(t, err)
+		co, err := v.AsCoroutine()
+		require.NoError(t, err)
+		assert.Equal(t, stackvm.CoroutineSuspended, co.Status())
+
+		for i, expected := range []int32{0, 1, -1} {
+			var args []stackvm.Value
+			if i == 0 {
+				args = append(args, stackvm.NewInt(2))
+			}
+			values, err := co.Resume(args...)
+			require.NoError(t, err)
+			assert.Equal(t, []stackvm.Value{stackvm.NewInt(expected)}, values)
+		}
+		assert.Equal(t, stackvm.CoroutineDead, co.Status())
+
+		_, err = co.Resume()
+		assert.ErrorIs(t, err, stackvm.ErrIllegalState)
+	})
+
+	t.Run("values passed on resume", func(t *testing.T) {
+		vm := stackvm.New(stackvm.WithVerification())
+		v, err := stackvm.NewCoroutine(vm, stackvm.NewFunction(vm, acc))
+		require.NoError(t, err)
+		co, err := v.AsCoroutine()
+		require.NoError(t, err)
+
+		values, err := co.Resume()
+		require.NoError(t, err)
+		assert.Equal(t, []stackvm.Value{stackvm.NewInt(0)}, values)
+		values, err = co.Resume(stackvm.NewInt(5))
+		require.NoError(t, err)
+		assert.Equal(t, []stackvm.Value{stackvm.NewInt(5)}, values)
+		values, err = co.Resume(stackvm.NewInt(2))
+		require.NoError(t, err)
+		assert.Equal(t, []stackvm.Value{stackvm.NewInt(7)}, values)
+
+		_, err = co.Resume()
+		assert.ErrorIs(t, err, stackvm.ErrArityMismatch)
+		assert.Equal(t, stackvm.CoroutineSuspended, co.Status())
+	})
+
+	t.Run("exception propagates to resumer", func(t *testing.T) {
+		// try { resume(coroutine(fail)) } catch (e) { return e }
+		main, err := stackvm.NewFuncProto(0, func(b *stackvm.FuncProtoBuilder) {
+			b.Emit(stackvm.PUSHK(b.AddProto(fail)))
+			b.Emit(stackvm.COROUTINE())
+			b.EmitTry(func() {
+				b.Emit(stackvm.DUP(0))
+				b.Emit(stackvm.RESUME(0, 0))
+			}, func() {
+				b.Emit(stackvm.RET(1))
+			}, nil)
+			b.Emit(stackvm.RET(0))
+		})
+		require.NoError(t, err)
+		values, err := stackvm.New(stackvm.WithVerification()).Run(main)
+		require.NoError(t, err)
+		assert.Equal(t, []stackvm.Value{stackvm.NewString("boom")}, values)
+	})
+
+	t.Run("yield outside coroutine", func(t *testing.T) {
+		main, err := stackvm.NewFuncProto(0, func(b *stackvm.FuncProtoBuilder) {
+			b.Emit(stackvm.YIELD(0, 0))
+			b.Emit(stackvm.RET(0))
+		})
+		require.NoError(t, err)
+		_, err = stackvm.New().Run(main)
+		assert.ErrorIs(t, err, stackvm.ErrIllegalState)
+	})
+}
+
 type funcSample struct {
 	args     []stackvm.Value
 	expected []stackvm.Value
 }
+
+func FuzzVM(f *testing.F) {
+	for _, code := range [][]stackvm.Inst{
+		{stackvm.PUSHI(1), stackvm.PUSHI(0), stackvm.DIVI(), stackvm.RET(1)},
+		{stackvm.PUSHK(0), stackvm.CALL(1, 1), stackvm.RET(1)},
+		{stackvm.DUP(0), stackvm.BR(0), stackvm.JMP(3), stackvm.RETV(0)},
+		{stackvm.PUSHI(1), stackvm.VARARG(), stackvm.COROUTINE(), stackvm.RESUME(0, 1), stackvm.RET(1)},
+	} {
+		data := make([]byte, 0, 8*len(code))
+		for _, inst := range code {
+			data = binary.LittleEndian.AppendUint64(data, uint64(inst))
+		}
+		f.Add(uint8(1), data)
+	}
+	host := stackvm.NewHostFunction("id", func(vm *stackvm.VirtualMachine, args []stackvm.Value) ([]stackvm.Value, error) {
+		return args, nil
+	})
+
+	id, err := stackvm.NewFuncProto(1, func(b *stackvm.FuncProtoBuilder) {
+		b.Emit(stackvm.RET(1))
+	})
+	require.NoError(f, err)
+
+	f.Fuzz(func(t *testing.T, nargs uint8, data []byte) {
+		args := make([]stackvm.Value, nargs%4)
+		for i := range args {
+			args[i] = stackvm.NewInt(int32(i))
+		}
+		proto, err := stackvm.NewFuncProto(len(args), func(b *stackvm.FuncProtoBuilder) {
+			b.AddConst(host)
+			b.AddConst(stackvm.NewString("g"))
+			b.AddConst(stackvm.NewFloat(1.5))
+			for ; len(data) >= 8; data = data[8:] {
+				b.Emit(stackvm.Inst(binary.LittleEndian.Uint64(data)))
+			}
+		})
+		require.NoError(t, err)
+		for _, verify := range []bool{false, true} {
+			opts := []stackvm.Option{stackvm.WithInstructionLimit(1000), stackvm.WithStackLimit(64)}
+			if verify {
+				opts = append(opts, stackvm.WithVerification())
+			}
+			vm := stackvm.New(opts...)
+			for range 2 {
+				_, err := vm.Run(proto, args...)
+				assert.NotErrorIs(t, err, stackvm.ErrInternal)
+				if errors.Is(err, stackvm.ErrIllegalState) {
+					// Raised by the bytecode, not by starting the run.
+					var rerr *stackvm.RuntimeError
+					assert.ErrorAs(t, err, &rerr)
+				}
+				if errors.Is(err, stackvm.ErrSuspended) {
+					require.NoError(t, vm.Reset())
+				}
+			}
+			values, err := vm.Run(id, stackvm.NewInt(7))
+			require.NoError(t, err)
+			assert.Equal(t, []stackvm.Value{stackvm.NewInt(7)}, values)
+		}
+	})
+}